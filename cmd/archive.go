@@ -0,0 +1,462 @@
+package cmd
+
+import (
+    "archive/tar"
+    "archive/zip"
+    "compress/gzip"
+    "context"
+    "database/sql"
+    "fmt"
+    "io"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/bodgit/sevenzip"
+    "github.com/cespare/xxhash"
+    "github.com/klauspost/compress/zstd"
+)
+
+// Archives are imported like folders: their members are extracted one at a
+// time and go through the same pipeline as other files. Members are known
+// by the path of the archive followed by "!/" and their name, and archives
+// inside archives are opened in turn.
+//
+// Members are written to a staging folder inside the library and hashed on
+// the way, so that importing them takes a single read of the archive and
+// placing them in the library is a rename.
+
+// stagingDirName is the staging folder in the library.
+const stagingDirName = tempFilePrefix + "staging"
+
+// maxArchiveDepth is how deep archives inside archives are opened, which
+// stops archives that contain themselves.
+const maxArchiveDepth = 4
+
+// stagedHeadSize is how much of a staged member is kept in memory to read
+// its metadata from. Exif data in JPEG files is at most 64 KiB.
+const stagedHeadSize = 256 * 1024
+
+// Kinds of archive
+const (
+    archiveZip    = "zip"
+    archiveTar    = "tar"
+    archiveTarGz  = "tar.gz"
+    archiveTarZst = "tar.zst"
+    archive7z     = "7z"
+)
+
+var archiveSuffixes = []struct {
+    suffix string
+    kind   string
+}{
+    {".zip", archiveZip},
+    {".tar", archiveTar},
+    {".tar.gz", archiveTarGz},
+    {".tgz", archiveTarGz},
+    {".tar.zst", archiveTarZst},
+    {".tzst", archiveTarZst},
+    {".7z", archive7z},
+}
+
+// archiveKind returns the kind of archive a file is by its name, or "" if
+// it is no archive.
+func archiveKind(name string) string {
+    lower := strings.ToLower(name)
+    for _, s := range archiveSuffixes {
+        if strings.HasSuffix(lower, s.suffix) {
+            return s.kind
+        }
+    }
+    return ""
+}
+
+// archiveMember is a file in an archive. Tar archives can only be read
+// front to back, so open is only valid until the next member is read.
+type archiveMember struct {
+    name string
+    info fs.FileInfo
+    open func() (io.ReadCloser, error)
+}
+
+// archiveReader lists the members of an archive in order.
+type archiveReader interface {
+    // next returns io.EOF after the last member
+    next() (archiveMember, error)
+    Close() error
+}
+
+func openArchive(path string) (archiveReader, error) {
+    switch archiveKind(path) {
+    case archiveZip:
+        reader, err := zip.OpenReader(path)
+        if err != nil {
+            return nil, err
+        }
+        return &zipArchive{reader: reader}, nil
+    case archive7z:
+        reader, err := sevenzip.OpenReader(path)
+        if err != nil {
+            return nil, err
+        }
+        return &sevenZipArchive{reader: reader}, nil
+    case archiveTar, archiveTarGz, archiveTarZst:
+        return openTarArchive(path)
+    }
+    return nil, fmt.Errorf("not an archive: %s", path)
+}
+
+type zipArchive struct {
+    reader *zip.ReadCloser
+    i      int
+}
+
+func (a *zipArchive) next() (archiveMember, error) {
+    if a.i >= len(a.reader.File) {
+        return archiveMember{}, io.EOF
+    }
+    file := a.reader.File[a.i]
+    a.i++
+    return archiveMember{name: file.Name, info: file.FileInfo(), open: file.Open}, nil
+}
+
+func (a *zipArchive) Close() error {
+    return a.reader.Close()
+}
+
+type sevenZipArchive struct {
+    reader *sevenzip.ReadCloser
+    i      int
+}
+
+func (a *sevenZipArchive) next() (archiveMember, error) {
+    if a.i >= len(a.reader.File) {
+        return archiveMember{}, io.EOF
+    }
+    file := a.reader.File[a.i]
+    a.i++
+    return archiveMember{name: file.Name, info: file.FileInfo(), open: file.Open}, nil
+}
+
+func (a *sevenZipArchive) Close() error {
+    return a.reader.Close()
+}
+
+type tarArchive struct {
+    file         *os.File
+    decompressor io.ReadCloser // nil for uncompressed archives
+    reader       *tar.Reader
+}
+
+func openTarArchive(path string) (*tarArchive, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    archive := &tarArchive{file: file}
+    var stream io.Reader = file
+    switch archiveKind(path) {
+    case archiveTarGz:
+        archive.decompressor, err = gzip.NewReader(file)
+    case archiveTarZst:
+        var decoder *zstd.Decoder
+        decoder, err = zstd.NewReader(file)
+        if err == nil {
+            archive.decompressor = decoder.IOReadCloser()
+        }
+    }
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
+    if archive.decompressor != nil {
+        stream = archive.decompressor
+    }
+    archive.reader = tar.NewReader(stream)
+    return archive, nil
+}
+
+func (a *tarArchive) next() (archiveMember, error) {
+    header, err := a.reader.Next()
+    if err != nil {
+        return archiveMember{}, err
+    }
+    return archiveMember{
+        // tar files made with "tar cf x.tar ." name their members ./name
+        name: strings.TrimPrefix(header.Name, "./"),
+        info: header.FileInfo(),
+        open: func() (io.ReadCloser, error) { return io.NopCloser(a.reader), nil },
+    }, nil
+}
+
+func (a *tarArchive) Close() error {
+    if a.decompressor != nil {
+        a.decompressor.Close()
+    }
+    return a.file.Close()
+}
+
+// processArchive imports the members of the archive at path. key names the
+// archive in the journal and in messages, for nested archives it is the key
+// of the member the archive was extracted from. depth counts the archives
+// it is inside of.
+func processArchive(ctx context.Context, path, key string, depth int, pipeline *importPipeline) error {
+    reader, err := openArchive(path)
+    if err != nil {
+        return err
+    }
+    defer reader.Close()
+    root := stagingRoot(pipeline.destDir)
+    if err := os.MkdirAll(root, os.ModePerm); err != nil {
+        return fmt.Errorf("failed to create staging folder: %w", err)
+    }
+    // Only succeed once nested archives and other imports are done with them
+    defer os.Remove(filepath.Dir(root))
+    defer os.Remove(root)
+    // Use the archive name as the temp folder name
+    tempDir, err := os.MkdirTemp(root, fmt.Sprintf("%s_", filepath.Base(path)))
+    if err != nil {
+        return fmt.Errorf("failed to create temp directory: %w", err)
+    }
+    defer os.RemoveAll(tempDir) // Clean up temp directory when done
+
+    // Extracted members are processed asynchronously, wait for all of them
+    // before the temp directory is removed.
+    var pending sync.WaitGroup
+    defer pending.Wait()
+
+    // Members whose Takeout JSON file was not read before the import may
+    // find it further on
+    scanned := takeoutScanned(path, depth)
+    if takeoutMode && !scanned {
+        pipeline.startArchive(key)
+        defer pipeline.endArchive(key)
+    }
+
+    for {
+        select {
+        case <-ctx.Done():
+            return context.Canceled
+        default:
+        }
+        file, err := reader.next()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if !file.info.Mode().IsRegular() {
+            continue
+        }
+        member := sourceFile{key: key + "!/" + file.name, size: file.info.Size(), modTime: file.info.ModTime()}
+
+        if archiveKind(file.name) != "" {
+            err = processNestedArchive(ctx, file, member, tempDir, depth+1, pipeline)
+            if err != nil {
+                if err == context.Canceled {
+                    return err
+                }
+                logger.Printf("Error processing archive %s: %v\n", member.key, err)
+                fmt.Printf("Error processing archive %s: %v\n", member.key, err)
+                pipeline.stats.countError()
+            }
+            continue
+        }
+        if takeoutMode && isTakeoutJSON(file.name) {
+            if !scanned {
+                if err := readTakeoutMember(file); err != nil {
+                    logger.Printf("Warning: Could not read Takeout JSON file %s: %v\n", member.key, err)
+                    fmt.Printf("Warning: could not read Takeout JSON file %s: %v\n", member.key, err)
+                } else {
+                    pipeline.takeoutJSONRead(key)
+                }
+            }
+            continue
+        }
+        if _, isMedia := isMediaFile(file.name); !isMedia {
+            updateStats(ImportResult{Status: "non_media", Message: "Not a supported media file", OriginalPath: member.key}, pipeline.stats)
+            continue
+        }
+        if currentSession.isDone(member) {
+            pipeline.stats.countResumed()
+            continue
+        }
+
+        pending.Add(1)
+        err = extractAndProcessFile(file, member, key, tempDir, pipeline, pending.Done)
+        if err != nil {
+            pending.Done()
+            if err == context.Canceled {
+                return err
+            }
+            logger.Printf("Error processing file %s from archive: %v\n", file.name, err)
+            fmt.Printf("Error processing file %s from archive: %v\n", file.name, err)
+            pipeline.stats.countError()
+        }
+    }
+}
+
+// processNestedArchive extracts an archive found inside another one and
+// imports its members.
+func processNestedArchive(ctx context.Context, file archiveMember, member sourceFile, tempDir string, depth int, pipeline *importPipeline) error {
+    if depth > maxArchiveDepth {
+        return fmt.Errorf("archives nested more than %d deep", maxArchiveDepth)
+    }
+    memberDir, err := os.MkdirTemp(tempDir, "archive_")
+    if err != nil {
+        return fmt.Errorf("failed to create temp directory: %w", err)
+    }
+    defer os.RemoveAll(memberDir)
+    path := filepath.Join(memberDir, filepath.Base(file.name))
+    if _, _, err := extractArchiveMember(file, path); err != nil {
+        return err
+    }
+    return processArchive(ctx, path, member.key, depth, pipeline)
+}
+
+// extractAndProcessFile stages an archive member in its own directory under
+// tempDir and queues it for import. done is called once the member has been
+// processed; it is not called if an error is returned.
+func extractAndProcessFile(file archiveMember, member sourceFile, archive, tempDir string, pipeline *importPipeline, done func()) error {
+    // Members are processed concurrently, so each gets a private directory
+    // in which it can keep its original name
+    memberDir, err := os.MkdirTemp(tempDir, "member_")
+    if err != nil {
+        return fmt.Errorf("failed to create temp directory: %w", err)
+    }
+
+    // Create a temporary file with the original name
+    tempFilePath := filepath.Join(memberDir, filepath.Base(file.name))
+    hash, head, err := extractArchiveMember(file, tempFilePath)
+    if err != nil {
+        os.RemoveAll(memberDir)
+        return err
+    }
+
+    // Process the staged file, what is left of it is cleaned up once the
+    // pipeline is done with it
+    return pipeline.submit(importJob{
+        sourcePath: tempFilePath,
+        file:       member,
+        staged:     true,
+        hash:       hash,
+        head:       head,
+        archive:    archive,
+        done: func() {
+            os.RemoveAll(memberDir)
+            done()
+        },
+    })
+}
+
+
+// extractArchiveMember writes an archive member to tempFilePath. It returns
+// the hash of the member and its first stagedHeadSize bytes.
+func extractArchiveMember(file archiveMember, tempFilePath string) (uint64, []byte, error) {
+    tempFile, err := os.Create(tempFilePath)
+    if err != nil {
+        return 0, nil, fmt.Errorf("failed to create temp file: %w", err)
+    }
+    defer tempFile.Close()
+
+    // Extract the file
+    archivedFile, err := file.open()
+    if err != nil {
+        return 0, nil, fmt.Errorf("failed to open archived file: %w", err)
+    }
+    defer archivedFile.Close()
+
+    hasher := xxhash.New()
+    head := &headBuffer{size: stagedHeadSize}
+    _, err = io.Copy(tempFile, io.TeeReader(archivedFile, io.MultiWriter(hasher, head)))
+    if err != nil {
+        return 0, nil, fmt.Errorf("failed to extract file: %w", err)
+    }
+
+    // Ensure all data is written to disk
+    err = tempFile.Sync()
+    if err != nil {
+        return 0, nil, fmt.Errorf("failed to sync temp file: %w", err)
+    }
+
+    // Close the file to ensure we can modify its timestamps
+    tempFile.Close()
+
+    // Set the modification time of the temporary file to match the original file in the archive
+    err = os.Chtimes(tempFilePath, time.Now(), file.info.ModTime())
+    if err != nil {
+        return 0, nil, fmt.Errorf("failed to set file times: %w", err)
+    }
+    return hasher.Sum64(), head.data, nil
+}
+
+// headBuffer keeps the first size bytes written to it.
+type headBuffer struct {
+    data []byte
+    size int
+}
+
+func (h *headBuffer) Write(p []byte) (int, error) {
+    if n := h.size - len(h.data); n > 0 {
+        if n > len(p) {
+            n = len(p)
+        }
+        h.data = append(h.data, p[:n]...)
+    }
+    return len(p), nil
+}
+
+// stagingRoot returns the folder archive members are staged in: inside the
+// library, so that they can be renamed into place. Each session has its own,
+// so that imports running at the same time leave each other's alone.
+func stagingRoot(destDir string) string {
+    if dryRun {
+        // Nothing is written to the library in a dry run
+        return filepath.Join(os.TempDir(), stagingDirName, fmt.Sprintf("dry-run-%d", os.Getpid()))
+    }
+    return filepath.Join(destDir, stagingDirName, strconv.FormatInt(currentSession.id, 10))
+}
+
+// removeStaleStaging deletes what imports that are no longer running left
+// in the staging folder.
+func removeStaleStaging(db *sql.DB, destDir string) error {
+    root := filepath.Join(destDir, stagingDirName)
+    entries, err := os.ReadDir(root)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    live, err := liveSessions(db)
+    if err != nil {
+        return err
+    }
+    for _, entry := range entries {
+        if id, err := strconv.ParseInt(entry.Name(), 10, 64); err == nil && live[id] {
+            continue
+        }
+        if err := os.RemoveAll(filepath.Join(root, entry.Name())); err != nil {
+            return err
+        }
+    }
+    os.Remove(root)
+    return nil
+}
+
+// placeStagedFile moves a staged archive member to its place in the library.
+func placeStagedFile(src, dst string) (renamed bool, err error) {
+    if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+        return false, err
+    }
+    if err := os.Rename(src, dst); err != nil {
+        return false, err
+    }
+    syncDir(filepath.Dir(dst))
+    return true, nil
+}
@@ -0,0 +1,208 @@
+package cmd
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/spf13/cobra"
+    "github.com/spf13/pflag"
+    "gopkg.in/yaml.v3"
+)
+
+// Settings are resolved in this order, later sources overriding earlier ones:
+//
+//   1. built-in flag defaults
+//   2. the user config file (~/.picmover.yaml or --config)
+//   3. the library config file (picmover.yaml next to media.db)
+//   4. the selected profile from the user config file
+//   5. the selected profile from the library config file
+//   6. environment variables, PICMOVER_<COMMAND>_<FLAG>
+//   7. flags given on the command line
+const (
+    userConfigName    = ".picmover.yaml"
+    libraryConfigName = "picmover.yaml"
+    envPrefix         = "PICMOVER_"
+
+    // libraryArgAnnotation names the positional argument of a command that
+    // holds the library (destination) directory. Negative values count from
+    // the last argument.
+    libraryArgAnnotation = "library_arg"
+)
+
+var (
+    cfgFile     string
+    profileName string
+)
+
+// configSection maps flag names of one command to their values.
+type configSection map[string]interface{}
+
+// configFile is the content of a picmover config file. Top level keys are
+// command names, e.g.
+//
+//   import:
+//     workers: 4
+//     layout: "{year}/{month}/{basename}"
+//   profiles:
+//     phone-backup:
+//       import:
+//         move: true
+type configFile struct {
+    Commands map[string]configSection            `yaml:",inline"`
+    Profiles map[string]map[string]configSection `yaml:"profiles"`
+}
+
+func loadConfigFile(path string) (*configFile, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var config configFile
+    if err := yaml.Unmarshal(data, &config); err != nil {
+        return nil, fmt.Errorf("error parsing %s: %w", path, err)
+    }
+    return &config, nil
+}
+
+// applyConfig sets every flag of cmd that was not given on the command line
+// from the config files and the environment.
+func applyConfig(cmd *cobra.Command, args []string) error {
+    if cfgFile == "" {
+        cfgFile = os.Getenv(envPrefix + "CONFIG")
+    }
+    if profileName == "" {
+        profileName = os.Getenv(envPrefix + "PROFILE")
+    }
+
+    var files []*configFile
+    var names []string
+
+    userConfig := cfgFile
+    if userConfig == "" {
+        if home, err := os.UserHomeDir(); err == nil {
+            userConfig = filepath.Join(home, userConfigName)
+        }
+    }
+    if userConfig != "" {
+        config, err := loadConfigFile(userConfig)
+        if err == nil {
+            files = append(files, config)
+            names = append(names, userConfig)
+        } else if cfgFile != "" || !os.IsNotExist(err) {
+            // A missing default file is fine, an explicitly requested one is not
+            return err
+        }
+    }
+
+    if index, ok := cmd.Annotations[libraryArgAnnotation]; ok {
+        i, err := strconv.Atoi(index)
+        if i < 0 {
+            // Counted from the end, for commands with optional leading arguments
+            i += len(args)
+        }
+        if err == nil && i >= 0 && i < len(args) {
+            libraryConfig := filepath.Join(args[i], libraryConfigName)
+            config, err := loadConfigFile(libraryConfig)
+            if err == nil {
+                files = append(files, config)
+                names = append(names, libraryConfig)
+            } else if !os.IsNotExist(err) {
+                return err
+            }
+        }
+    }
+
+    values := make(map[string]string)
+    for i, config := range files {
+        if err := collectSection(cmd, config.Commands, names[i], values); err != nil {
+            return err
+        }
+    }
+    if profileName != "" {
+        found := false
+        for i, config := range files {
+            profile, ok := config.Profiles[profileName]
+            if !ok {
+                continue
+            }
+            found = true
+            if err := collectSection(cmd, profile, fmt.Sprintf("%s (profile %s)", names[i], profileName), values); err != nil {
+                return err
+            }
+        }
+        if !found {
+            return fmt.Errorf("profile %q not found in %s", profileName, strings.Join(names, ", "))
+        }
+    }
+
+    var err error
+    cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+        env := envPrefix + envName(cmd.Name()) + "_" + envName(flag.Name)
+        if value, ok := os.LookupEnv(env); ok {
+            values[flag.Name] = value
+        }
+        value, ok := values[flag.Name]
+        if !ok || flag.Changed || err != nil {
+            return
+        }
+        if setErr := cmd.Flags().Set(flag.Name, value); setErr != nil {
+            err = fmt.Errorf("invalid value %q for %s: %w", value, flag.Name, setErr)
+        }
+    })
+    return err
+}
+
+// collectSection adds the settings for cmd from one config section to values.
+// Sections for other commands are only checked for unknown names.
+func collectSection(cmd *cobra.Command, sections map[string]configSection, source string, values map[string]string) error {
+    for commandName, section := range sections {
+        target, _, err := cmd.Root().Find([]string{commandName})
+        if err != nil || target == cmd.Root() || target.Name() != commandName {
+            return fmt.Errorf("%s: unknown command %q", source, commandName)
+        }
+        for key, value := range section {
+            if target.Flags().Lookup(key) == nil {
+                return fmt.Errorf("%s: unknown option %q for %s", source, key, commandName)
+            }
+            if target == cmd {
+                values[key] = configValue(value)
+            }
+        }
+    }
+    return nil
+}
+
+// configValue converts a YAML value to the string form the flag parses.
+func configValue(value interface{}) string {
+    switch v := value.(type) {
+    case []interface{}:
+        parts := make([]string, len(v))
+        for i, item := range v {
+            parts[i] = configValue(item)
+        }
+        return strings.Join(parts, ",")
+    case map[string]interface{}:
+        keys := make([]string, 0, len(v))
+        for key := range v {
+            keys = append(keys, key)
+        }
+        sort.Strings(keys)
+        parts := make([]string, len(keys))
+        for i, key := range keys {
+            parts[i] = key + "=" + configValue(v[key])
+        }
+        return strings.Join(parts, ",")
+    case nil:
+        return ""
+    default:
+        return fmt.Sprint(v)
+    }
+}
+
+func envName(name string) string {
+    return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
@@ -4,6 +4,7 @@ import (
     "database/sql"
     "fmt"
     "path/filepath"
+    "strings"
 
 
     "github.com/spf13/cobra"
@@ -12,8 +13,15 @@ import (
 
 
 var (
-    listFiles bool
-    limit     int
+    listFiles     bool
+    listSessions  bool
+    repairDB      bool
+    listPlaces    bool
+    listHalves    bool
+    placeName     string
+    dateSource    string
+    lowConfidence bool
+    limit         int
 )
 
 var dbCmd = &cobra.Command{
@@ -21,6 +29,7 @@ var dbCmd = &cobra.Command{
     Short: "Query the image database",
     Long:  `Query and display information from the image database.`,
     Args:  cobra.ExactArgs(1),
+    Annotations: map[string]string{libraryArgAnnotation: "0"},
     Run: func(cmd *cobra.Command, args []string) {
         destDir := args[0]
         queryDatabase(destDir)
@@ -30,22 +39,41 @@ var dbCmd = &cobra.Command{
 func init() {
     rootCmd.AddCommand(dbCmd)
     dbCmd.Flags().BoolVarP(&listFiles, "list", "l", false, "List files in the database")
+    dbCmd.Flags().BoolVar(&repairDB, "repair", false, "Finalize or remove entries left pending by an interrupted import")
+    dbCmd.Flags().BoolVar(&listSessions, "sessions", false, "List import sessions and their progress")
+    dbCmd.Flags().BoolVar(&listPlaces, "places", false, "List places with the number of files taken there")
+    dbCmd.Flags().BoolVar(&listHalves, "orphaned-halves", false, "List halves of RAW+JPEG pairs and Live Photos whose other half is no longer in the library")
+    dbCmd.Flags().StringVar(&placeName, "place", "", "Only show files taken in this city, region or country")
+    dbCmd.Flags().StringVar(&dateSource, "date-source", "", "Only show files dated from this source, e.g. DateTimeOriginal, filename or mtime")
+    dbCmd.Flags().BoolVar(&lowConfidence, "low-confidence", false, "Only show files whose date may be wrong (EXIF DateTime, folder name, modification time or unknown)")
     dbCmd.Flags().IntVarP(&limit, "limit", "n", 10, "Limit the number of files to display (default 100, use 0 for no limit)")
 }
 
 func queryDatabase(destDir string) {
-    dbPath := filepath.Join(destDir, "media.db")
-    db, err := sql.Open("sqlite3", dbPath)
+    if repairDB {
+        repairDatabase(destDir)
+        return
+    }
+    // The queries need the current tables and columns, but only reading
+    // is no reason to rewrite rows in migrations
+    db, err := openDBSchema(filepath.Join(destDir, "media.db"))
     if err != nil { 
         fmt.Printf("Error opening database: %v\n", err)
         return
     }
     defer db.Close()
 
-    if listFiles {
+    if listSessions {
+        displaySessions(db)
+    } else if listPlaces {
+        displayPlaces(db)
+    } else if listHalves {
+        displayOrphanedHalves(db)
+    } else if listFiles {
         displayFileList(db)
     } else {
         displaySummary(db)
+        displayDateSources(db)
         displayRecentFiles(db)
     }
 }
@@ -54,7 +82,8 @@ func displaySummary(db *sql.DB) {
         SELECT 
             COUNT(*) as total,
             SUM(CASE WHEN file_type = 'image' THEN 1 ELSE 0 END) as images,
-            SUM(CASE WHEN file_type = 'video' THEN 1 ELSE 0 END) as videos,
+            SUM(CASE WHEN file_type = 'video' AND COALESCE(motion_role, '') != 'motion' THEN 1 ELSE 0 END) as videos,
+            SUM(CASE WHEN motion_role IN ('still', 'motion_photo') THEN 1 ELSE 0 END) as motion_photos,
             MIN(date_taken) as earliest,
             MAX(date_taken) as latest,
             COUNT(DISTINCT camera_model) as unique_cameras,
@@ -69,9 +98,9 @@ func displaySummary(db *sql.DB) {
     defer rows.Close()
 
     if rows.Next() {
-        var total, images, videos, uniqueCameras, uniqueMakes, locationsWithGPS int
+        var total, images, videos, motionPhotos, uniqueCameras, uniqueMakes, locationsWithGPS int
         var earliest, latest string
-        err := rows.Scan(&total, &images, &videos, &earliest, &latest, &uniqueCameras, &uniqueMakes, &locationsWithGPS)
+        err := rows.Scan(&total, &images, &videos, &motionPhotos, &earliest, &latest, &uniqueCameras, &uniqueMakes, &locationsWithGPS)
         if err != nil {
             fmt.Printf("Error scanning row: %v\n", err)
             return
@@ -80,6 +109,7 @@ func displaySummary(db *sql.DB) {
         fmt.Printf("Total files: %d\n", total)
         fmt.Printf("Images: %d\n", images)
         fmt.Printf("Videos: %d\n", videos)
+        fmt.Printf("Live and motion photos: %d\n", motionPhotos)
         fmt.Printf("Date range: %s to %s\n", earliest, latest)
         fmt.Printf("Unique camera models: %d\n", uniqueCameras)
         fmt.Printf("Unique camera makes: %d\n", uniqueMakes)
@@ -88,15 +118,42 @@ func displaySummary(db *sql.DB) {
 }
 
 
+// displayDateSources shows how many dates came from each source.
+func displayDateSources(db *sql.DB) {
+    rows, err := db.Query(`
+        SELECT COALESCE(date_source, 'unknown'), COUNT(*)
+        FROM media
+        GROUP BY date_source
+        ORDER BY COUNT(*) DESC
+    `)
+    if err != nil {
+        fmt.Printf("Error querying date sources: %v\n", err)
+        return
+    }
+    defer rows.Close()
+
+    fmt.Printf("Date sources:\n")
+    for rows.Next() {
+        var source string
+        var count int
+        if err := rows.Scan(&source, &count); err != nil {
+            fmt.Printf("Error scanning row: %v\n", err)
+            continue
+        }
+        fmt.Printf("  %s: %d\n", source, count)
+    }
+}
+
 func displayRecentFiles(db *sql.DB) {
     fmt.Printf("\nMost Recent Files:\n")
+    where, args := mediaFilter()
     query := `
         SELECT new_path, date_taken, file_type
-        FROM media
+        FROM media` + where + `
         ORDER BY date_taken DESC
         LIMIT ?
     `
-    rows, err := db.Query(query, limit)
+    rows, err := db.Query(query, append(args, limit)...)
     if err != nil {
         fmt.Printf("Error querying recent files: %v\n", err)
         return
@@ -114,9 +171,12 @@ func displayRecentFiles(db *sql.DB) {
     }
 }
 func displayFileList(db *sql.DB) {
+    where, args := mediaFilter()
     query := `
-        SELECT id, hash, original_path, new_path, date_taken, file_type, location, camera_model, camera_make, camera_type, resolution
-        FROM media
+        SELECT id, hash, original_path, new_path, date_taken, COALESCE(date_source, 'unknown'), file_type, location,
+            COALESCE(city, ''), COALESCE(region, ''), COALESCE(country, ''),
+            camera_model, camera_make, camera_type, resolution
+        FROM media` + where + `
         ORDER BY date_taken DESC
     `
     var rows *sql.Rows
@@ -124,10 +184,9 @@ func displayFileList(db *sql.DB) {
     
     if limit > 0 {
         query += " LIMIT ?"
-        rows, err = db.Query(query, limit)
-    } else {
-        rows, err = db.Query(query)
+        args = append(args, limit)
     }
+    rows, err = db.Query(query, args...)
 
     if err != nil {
         fmt.Printf("Error querying files: %v\n", err)
@@ -136,25 +195,164 @@ func displayFileList(db *sql.DB) {
     defer rows.Close()
 
     fmt.Println("File List:")
-    fmt.Println("ID | Hash | Original Path | New Path | Date Taken | File Type | Location | Camera Model | Camera Make | Camera Type | Resolution")
+    fmt.Println("ID | Hash | Original Path | New Path | Date Taken | Date Source | File Type | Location | Place | Camera Model | Camera Make | Camera Type | Resolution")
     fmt.Println("-------------------------------------------------------------------------------------------------------------------")
 
     count := 0
     for rows.Next() {
         var id int
         var hash int64
-        var originalPath, newPath, dateTaken, fileType, location, cameraModel, cameraMake, cameraType, resolution string
-        err := rows.Scan(&id, &hash, &originalPath, &newPath, &dateTaken, &fileType, &location, &cameraModel, &cameraMake, &cameraType, &resolution)
+        var originalPath, newPath, dateTaken, source, fileType, location, cameraModel, cameraMake, cameraType, resolution string
+        var place MediaMetadata
+        err := rows.Scan(&id, &hash, &originalPath, &newPath, &dateTaken, &source, &fileType, &location, &place.City, &place.Region, &place.Country, &cameraModel, &cameraMake, &cameraType, &resolution)
         if err != nil {
             fmt.Printf("Error scanning row: %v\n", err)
             continue
         }
-        fmt.Printf("%d | %d | %s | %s | %s | %s | %s | %s | %s | %s | %s\n",
-            id, hash, originalPath, newPath, dateTaken, fileType, location, cameraModel, cameraMake, cameraType, resolution)
+        fmt.Printf("%d | %d | %s | %s | %s | %s | %s | %s | %s | %s | %s | %s | %s\n",
+            id, hash, originalPath, newPath, dateTaken, source, fileType, location, formatPlace(place), cameraModel, cameraMake, cameraType, resolution)
         count++
     }
 
     fmt.Printf("\nTotal files displayed: %d\n", count)
 }
 
+// mediaFilter returns the WHERE clause selecting files taken at --place and
+// dated from --date-source or a --low-confidence source.
+func mediaFilter() (string, []interface{}) {
+    var conditions []string
+    var args []interface{}
+    if placeName != "" {
+        conditions = append(conditions, "(country LIKE ? OR region LIKE ? OR city LIKE ?)")
+        args = append(args, placeName, placeName, placeName)
+    }
+    if dateSource != "" {
+        conditions = append(conditions, "date_source = ?")
+        args = append(args, dateSource)
+    }
+    if lowConfidence {
+        condition, conditionArgs := lowConfidenceFilter()
+        conditions = append(conditions, condition)
+        args = append(args, conditionArgs...)
+    }
+    if len(conditions) == 0 {
+        return "", nil
+    }
+    return `
+        WHERE ` + strings.Join(conditions, " AND "), args
+}
+
+func displayPlaces(db *sql.DB) {
+    where, args := mediaFilter()
+    rows, err := db.Query(`
+        SELECT COALESCE(country, ''), COALESCE(region, ''), COALESCE(city, ''), COUNT(*)
+        FROM media`+where+`
+        GROUP BY country, region, city
+        ORDER BY country, region, city
+    `, args...)
+    if err != nil {
+        fmt.Printf("Error querying places: %v\n", err)
+        return
+    }
+    defer rows.Close()
+
+    fmt.Println("Places:")
+    for rows.Next() {
+        var place MediaMetadata
+        var count int
+        if err := rows.Scan(&place.Country, &place.Region, &place.City, &count); err != nil {
+            fmt.Printf("Error scanning row: %v\n", err)
+            continue
+        }
+        name := formatPlace(place)
+        if name == "" {
+            name = "(unknown)"
+        }
+        fmt.Printf("%6d  %s\n", count, name)
+    }
+}
+
+// displayOrphanedHalves lists the files of RAW+JPEG pairs and Live Photos
+// whose other half was deleted or has gone missing.
+func displayOrphanedHalves(db *sql.DB) {
+    rows, err := db.Query(`
+        SELECT m.new_path, m.file_type, COALESCE(m.motion_role, ''), m.date_taken
+        FROM media m
+        WHERE m.shot_id IS NOT NULL AND m.status != ?
+            AND NOT EXISTS (SELECT 1 FROM media o WHERE o.shot_id = m.shot_id AND o.id != m.id AND o.status != ?)
+        ORDER BY m.date_taken
+    `, mediaMissing, mediaMissing)
+    if err != nil {
+        fmt.Printf("Error querying pairs: %v\n", err)
+        return
+    }
+    defer rows.Close()
+
+    count := 0
+    for rows.Next() {
+        var path, fileType, motionRole, dateTaken string
+        if err := rows.Scan(&path, &fileType, &motionRole, &dateTaken); err != nil {
+            fmt.Printf("Error scanning row: %v\n", err)
+            continue
+        }
+        half, other := "JPEG", "RAW"
+        switch {
+        case motionRole == motionStill:
+            half, other = "Live Photo", "video"
+        case motionRole == motionVideo:
+            half, other = "Live Photo video", "still"
+        case fileType == "image_raw":
+            half, other = "RAW", "JPEG"
+        }
+        fmt.Printf("%s - %s (%s without its %s)\n", dateTaken, path, half, other)
+        count++
+    }
+    fmt.Printf("\nOrphaned pair halves: %d\n", count)
+}
+
+func displaySessions(db *sql.DB) {
+    rows, err := db.Query(`
+        SELECT s.id, s.started_at, s.status, s.source_dir,
+            COUNT(j.source_path),
+            SUM(CASE WHEN j.state IN ('verified', 'skipped') THEN 1 ELSE 0 END)
+        FROM import_sessions s
+        LEFT JOIN import_journal j ON j.session_id = s.id
+        GROUP BY s.id
+        ORDER BY s.id DESC
+    `)
+    if err != nil {
+        fmt.Printf("Error querying import sessions: %v\n", err)
+        return
+    }
+    defer rows.Close()
+
+    fmt.Println("Import Sessions:")
+    fmt.Println("ID | Started | Status | Files Seen | Files Done | Source")
+    fmt.Println("-------------------------------------------------------------------------------------------------------------------")
+    for rows.Next() {
+        var id, seen int
+        var done sql.NullInt64
+        var startedAt, status, sourceDir string
+        err := rows.Scan(&id, &startedAt, &status, &sourceDir, &seen, &done)
+        if err != nil {
+            fmt.Printf("Error scanning row: %v\n", err)
+            continue
+        }
+        fmt.Printf("%d | %s | %s | %d | %d | %s\n", id, startedAt, status, seen, done.Int64, sourceDir)
+    }
+}
+
+func repairDatabase(destDir string) {
+    db, err := initDB(destDir)
+    if err != nil {
+        fmt.Printf("Error opening database: %v\n", err)
+        return
+    }
+    defer db.Close()
 
+    finalized, removed, err := repairPendingMedia(db)
+    if err != nil {
+        fmt.Printf("Error repairing database: %v\n", err)
+    }
+    fmt.Printf("Repair complete. Completed: %d, Removed: %d\n", finalized, removed)
+}
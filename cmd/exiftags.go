@@ -0,0 +1,93 @@
+package cmd
+
+import (
+    "bytes"
+    "encoding/binary"
+
+    "github.com/rwcarlsen/goexif/exif"
+    "github.com/rwcarlsen/goexif/tiff"
+)
+
+// Tags of the Exif sub-IFD that goexif does not know about.
+const (
+    BodySerialNumber    exif.FieldName = "BodySerialNumber"
+    OffsetTime          exif.FieldName = "OffsetTime"
+    OffsetTimeOriginal  exif.FieldName = "OffsetTimeOriginal"
+    OffsetTimeDigitized exif.FieldName = "OffsetTimeDigitized"
+)
+
+var extraExifFields = map[uint16]exif.FieldName{
+    0xA431: BodySerialNumber,
+    0x9010: OffsetTime,
+    0x9011: OffsetTimeOriginal,
+    0x9012: OffsetTimeDigitized,
+}
+
+func init() {
+    exif.RegisterParsers(extraExifParser{})
+}
+
+// extraExifParser loads extraExifFields from the Exif sub-IFD.
+type extraExifParser struct{}
+
+func (extraExifParser) Parse(x *exif.Exif) error {
+    pointer, err := x.Get(exif.ExifIFDPointer)
+    if err != nil {
+        return nil
+    }
+    offset, err := pointer.Int64(0)
+    if err != nil {
+        return nil
+    }
+    r := bytes.NewReader(x.Raw)
+    if _, err := r.Seek(offset, 0); err != nil {
+        return nil
+    }
+    dir, _, err := tiff.DecodeDir(r, x.Tiff.Order)
+    if err != nil {
+        // goexif's own parser already reports a broken sub-IFD
+        return nil
+    }
+    x.LoadTags(dir, extraExifFields, false)
+    return nil
+}
+
+// appleContentIdentifier returns the ContentIdentifier in the maker note of
+// photos taken by Apple devices, which is shared by the still and the video
+// of a Live Photo.
+func appleContentIdentifier(x *exif.Exif) string {
+    tag, err := x.Get(exif.MakerNote)
+    if err != nil {
+        return ""
+    }
+    // "Apple iOS\0", a version and the byte order, followed by a TIFF
+    // directory with offsets from the start of the maker note
+    note := tag.Val
+    if len(note) < 16 || !bytes.HasPrefix(note, []byte("Apple iOS\x00")) {
+        return ""
+    }
+    var order binary.ByteOrder = binary.BigEndian
+    if string(note[12:14]) == "II" {
+        order = binary.LittleEndian
+    }
+    count := int(order.Uint16(note[14:16]))
+    for i := 0; i < count; i++ {
+        entry := 16 + i*12
+        if entry+12 > len(note) {
+            break
+        }
+        if order.Uint16(note[entry:entry+2]) != 0x0011 || order.Uint16(note[entry+2:entry+4]) != 2 {
+            continue
+        }
+        size := int(order.Uint32(note[entry+4 : entry+8]))
+        offset := entry + 8
+        if size > 4 {
+            offset = int(order.Uint32(note[entry+8 : entry+12]))
+        }
+        if offset < 0 || offset+size > len(note) {
+            return ""
+        }
+        return string(bytes.TrimRight(note[offset:offset+size], "\x00"))
+    }
+    return ""
+}
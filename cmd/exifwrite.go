@@ -0,0 +1,181 @@
+package cmd
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// Rewriting of the EXIF date tags. The dates are fixed length text, so they
+// can be changed in place without restructuring the file. This works for
+// JPEG files and TIFF based RAW formats; the file is changed on a copy that
+// replaces it once written.
+
+const exifDateLayout = "2006:01:02 15:04:05"
+
+// exifDateTags are DateTime in IFD0 and DateTimeOriginal and
+// DateTimeDigitized in the Exif sub-IFD.
+var exifDateTags = map[uint16]bool{0x0132: true, 0x9003: true, 0x9004: true}
+
+// shiftExifDates adds shift to the EXIF dates of a file and returns the hash
+// of the changed file.
+func shiftExifDates(path string, shift time.Duration) (uint64, error) {
+    source, err := os.Open(path)
+    if err != nil {
+        return 0, err
+    }
+    defer source.Close()
+    info, err := source.Stat()
+    if err != nil {
+        return 0, err
+    }
+    tiffStart, err := findTIFFHeader(source, path)
+    if err != nil {
+        return 0, err
+    }
+    offsets, err := findExifDates(io.NewSectionReader(source, tiffStart, info.Size()-tiffStart))
+    if err != nil {
+        return 0, err
+    }
+    if len(offsets) == 0 {
+        return 0, fmt.Errorf("no EXIF dates found")
+    }
+
+    temp, err := os.CreateTemp(filepath.Dir(path), tempFilePrefix+"*.tmp")
+    if err != nil {
+        return 0, err
+    }
+    tempPath := temp.Name()
+    defer func() {
+        if err != nil {
+            temp.Close()
+            os.Remove(tempPath)
+        }
+    }()
+    if _, err = io.Copy(temp, source); err != nil {
+        return 0, err
+    }
+
+    date := make([]byte, len(exifDateLayout))
+    for _, offset := range offsets {
+        if _, err = temp.ReadAt(date, tiffStart+offset); err != nil {
+            return 0, err
+        }
+        t, parseErr := time.Parse(exifDateLayout, string(date))
+        if parseErr != nil {
+            // Unset dates are often blank or zero, leave them alone
+            continue
+        }
+        if _, err = temp.WriteAt([]byte(t.Add(shift).Format(exifDateLayout)), tiffStart+offset); err != nil {
+            return 0, err
+        }
+    }
+    // CreateTemp makes the file private to its owner
+    if err = temp.Chmod(info.Mode().Perm()); err != nil {
+        return 0, err
+    }
+    if err = temp.Sync(); err != nil {
+        return 0, err
+    }
+    if err = temp.Close(); err != nil {
+        return 0, err
+    }
+    if err = os.Chtimes(tempPath, info.ModTime(), info.ModTime()); err != nil {
+        return 0, err
+    }
+    hash, err := computeXXHash(tempPath)
+    if err != nil {
+        return 0, err
+    }
+    if err = os.Rename(tempPath, path); err != nil {
+        return 0, err
+    }
+    return hash, nil
+}
+
+// findTIFFHeader returns the offset of the TIFF structure holding the EXIF
+// data: the APP1 segment of a JPEG file, or the start of a TIFF based file.
+func findTIFFHeader(r io.ReaderAt, path string) (int64, error) {
+    header := make([]byte, 4)
+    if _, err := r.ReadAt(header, 0); err != nil {
+        return 0, err
+    }
+    if string(header[:2]) == "II" || string(header[:2]) == "MM" {
+        return 0, nil
+    }
+    if header[0] != 0xff || header[1] != 0xd8 {
+        return 0, fmt.Errorf("writing EXIF to %s files is not supported", strings.ToUpper(strings.TrimPrefix(filepath.Ext(path), ".")))
+    }
+
+    // Walk the JPEG segments up to the image data
+    segment := make([]byte, 10)
+    for offset := int64(2); ; {
+        if _, err := r.ReadAt(segment[:4], offset); err != nil {
+            return 0, fmt.Errorf("no EXIF data found")
+        }
+        if segment[0] != 0xff {
+            return 0, fmt.Errorf("invalid JPEG segment at offset %d", offset)
+        }
+        marker := segment[1]
+        if marker == 0xda || marker == 0xd9 {
+            return 0, fmt.Errorf("no EXIF data found")
+        }
+        length := int64(binary.BigEndian.Uint16(segment[2:4]))
+        if marker == 0xe1 && length >= 8 {
+            if _, err := r.ReadAt(segment[4:10], offset+4); err == nil && string(segment[4:10]) == "Exif\x00\x00" {
+                return offset + 10, nil
+            }
+        }
+        offset += 2 + length
+    }
+}
+
+// findExifDates returns the offsets of the date values within a TIFF
+// structure.
+func findExifDates(r io.ReaderAt) ([]int64, error) {
+    header := make([]byte, 8)
+    if _, err := r.ReadAt(header, 0); err != nil {
+        return nil, err
+    }
+    var order binary.ByteOrder = binary.LittleEndian
+    if bytes.HasPrefix(header, []byte("MM")) {
+        order = binary.BigEndian
+    }
+
+    var offsets []int64
+    var readIFD func(offset int64, depth int) error
+    readIFD = func(offset int64, depth int) error {
+        count := make([]byte, 2)
+        if _, err := r.ReadAt(count, offset); err != nil {
+            return err
+        }
+        entry := make([]byte, 12)
+        for i := 0; i < int(order.Uint16(count)); i++ {
+            if _, err := r.ReadAt(entry, offset+2+int64(i)*12); err != nil {
+                return err
+            }
+            tag := order.Uint16(entry[0:2])
+            valueType := order.Uint16(entry[2:4])
+            valueCount := order.Uint32(entry[4:8])
+            switch {
+            case exifDateTags[tag] && valueType == 2 && valueCount >= uint32(len(exifDateLayout)):
+                // Values over four bytes are stored at an offset
+                offsets = append(offsets, int64(order.Uint32(entry[8:12])))
+            case tag == 0x8769 && depth == 0:
+                if err := readIFD(int64(order.Uint32(entry[8:12])), depth+1); err != nil {
+                    return err
+                }
+            }
+        }
+        return nil
+    }
+    if err := readIFD(int64(order.Uint32(header[4:8])), 0); err != nil {
+        return nil, fmt.Errorf("invalid EXIF data: %w", err)
+    }
+    return offsets, nil
+}
@@ -0,0 +1,210 @@
+package cmd
+
+import (
+    "bufio"
+    "fmt"
+    "math"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// Offline reverse geocoding from a GeoNames cities dump, e.g. cities15000.txt
+// from https://download.geonames.org/export/dump/. Region and country names
+// come from admin1CodesASCII.txt and countryInfo.txt in the same directory;
+// without them the codes are used.
+
+// defaultGeoNamesFile is looked for in the library if --geonames is not given.
+var defaultGeoNamesFile = filepath.Join("geonames", "cities15000.txt")
+
+// maxPlaceDistance is how far from the nearest known place a position may be
+// and still be given its name, in kilometers.
+const maxPlaceDistance = 100.0
+
+// placeGeocoder is used by getMediaMetadata when set.
+var placeGeocoder *geocoder
+
+type place struct {
+    lat, long float64
+    city      string
+    region    string
+    country   string
+}
+
+// geocoder finds the nearest place using a grid of one degree cells.
+type geocoder struct {
+    cells map[[2]int][]place
+}
+
+func gridCell(lat, long float64) [2]int {
+    return [2]int{int(math.Floor(lat)), int(math.Floor(long))}
+}
+
+// setupGeocoder loads the GeoNames file for a library. An explicitly given
+// file must exist, the default one is optional.
+func setupGeocoder(path, destDir string) error {
+    if path == "" {
+        path = filepath.Join(destDir, defaultGeoNamesFile)
+        if _, err := os.Stat(path); os.IsNotExist(err) {
+            return nil
+        }
+    }
+    g, err := loadGeocoder(path)
+    if err != nil {
+        return err
+    }
+    placeGeocoder = g
+    return nil
+}
+
+func loadGeocoder(path string) (*geocoder, error) {
+    dir := filepath.Dir(path)
+    regions, err := loadGeoNamesTable(filepath.Join(dir, "admin1CodesASCII.txt"), 0, 1)
+    if err != nil {
+        return nil, err
+    }
+    countries, err := loadGeoNamesTable(filepath.Join(dir, "countryInfo.txt"), 0, 4)
+    if err != nil {
+        return nil, err
+    }
+
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, fmt.Errorf("error opening GeoNames file: %w", err)
+    }
+    defer file.Close()
+
+    g := &geocoder{cells: make(map[[2]int][]place)}
+    scanner := bufio.NewScanner(file)
+    // Lines with many alternate names can be long
+    scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+    line := 0
+    for scanner.Scan() {
+        line++
+        fields := strings.Split(scanner.Text(), "\t")
+        if len(fields) < 11 {
+            return nil, fmt.Errorf("%s:%d: not a GeoNames cities file", path, line)
+        }
+        lat, err1 := strconv.ParseFloat(fields[4], 64)
+        long, err2 := strconv.ParseFloat(fields[5], 64)
+        if err1 != nil || err2 != nil {
+            return nil, fmt.Errorf("%s:%d: invalid coordinates", path, line)
+        }
+        countryCode := fields[8]
+        p := place{
+            lat:     lat,
+            long:    long,
+            city:    fields[1],
+            region:  fields[10],
+            country: countryCode,
+        }
+        if name, ok := regions[countryCode+"."+fields[10]]; ok {
+            p.region = name
+        }
+        if name, ok := countries[countryCode]; ok {
+            p.country = name
+        }
+        cell := gridCell(lat, long)
+        g.cells[cell] = append(g.cells[cell], p)
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("error reading GeoNames file: %w", err)
+    }
+    return g, nil
+}
+
+// loadGeoNamesTable maps one column of a tab separated GeoNames table to
+// another. A missing file gives an empty map.
+func loadGeoNamesTable(path string, keyColumn, valueColumn int) (map[string]string, error) {
+    table := make(map[string]string)
+    file, err := os.Open(path)
+    if os.IsNotExist(err) {
+        return table, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        if strings.HasPrefix(scanner.Text(), "#") {
+            continue
+        }
+        fields := strings.Split(scanner.Text(), "\t")
+        if len(fields) > keyColumn && len(fields) > valueColumn {
+            table[fields[keyColumn]] = fields[valueColumn]
+        }
+    }
+    return table, scanner.Err()
+}
+
+// lookup returns the place nearest to a position, if one is close enough.
+func (g *geocoder) lookup(lat, long float64) (place, bool) {
+    var nearest place
+    best := math.Inf(1)
+    center := gridCell(lat, long)
+    // One degree of latitude is about 111 km, so the neighbouring rows of
+    // cells cover maxPlaceDistance. Degrees of longitude shrink towards the
+    // poles, where more columns are searched, up to all of them.
+    spanLong := 180
+    if c := math.Cos(math.Min(math.Abs(lat)+1, 90) * math.Pi / 180); c > 0 {
+        spanLong = int(math.Min(180, math.Ceil(maxPlaceDistance/(111*c))))
+    }
+    fromLong, toLong := center[1]-spanLong, center[1]+spanLong
+    if spanLong >= 180 {
+        fromLong, toLong = -180, 179
+    }
+    for dLat := -1; dLat <= 1; dLat++ {
+        for cellLong := fromLong; cellLong <= toLong; cellLong++ {
+            // Wrap around the antimeridian
+            column := cellLong
+            if column < -180 {
+                column += 360
+            } else if column >= 180 {
+                column -= 360
+            }
+            for _, p := range g.cells[[2]int{center[0] + dLat, column}] {
+                if d := distanceKm(lat, long, p.lat, p.long); d < best {
+                    best, nearest = d, p
+                }
+            }
+        }
+    }
+    return nearest, best <= maxPlaceDistance
+}
+
+// distanceKm is the great circle distance between two positions.
+func distanceKm(lat1, long1, lat2, long2 float64) float64 {
+    const earthRadius = 6371.0
+    toRad := math.Pi / 180
+    dLat := (lat2 - lat1) * toRad
+    dLong := (long2 - long1) * toRad
+    a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+        math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLong/2)*math.Sin(dLong/2)
+    return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// formatPlace returns "city, region, country", leaving out unknown parts.
+func formatPlace(m MediaMetadata) string {
+    var parts []string
+    for _, name := range []string{m.City, m.Region, m.Country} {
+        if name != "" {
+            parts = append(parts, name)
+        }
+    }
+    return strings.Join(parts, ", ")
+}
+
+// lookupPlace fills in the place names of a file with a GPS position.
+func lookupPlace(metadata *MediaMetadata) {
+    if placeGeocoder == nil || metadata.Latitude == nil || metadata.Longitude == nil {
+        return
+    }
+    if p, ok := placeGeocoder.lookup(*metadata.Latitude, *metadata.Longitude); ok {
+        metadata.Country = p.country
+        metadata.Region = p.region
+        metadata.City = p.city
+    }
+}
@@ -0,0 +1,301 @@
+package cmd
+
+import (
+    "encoding/xml"
+    "fmt"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/spf13/cobra"
+)
+
+var geotagCmd = &cobra.Command{
+    Use:   "geotag [archive_directory]",
+    Short: "Add GPS positions to files from GPX track logs",
+    Long: `Match the capture time of files without a GPS position against the points
+of one or more GPX track logs, e.g. from a phone GPS logger, and store the
+position in media.db. Between two track points the position is interpolated.
+
+A file is matched if it was taken between two track points at most --max-gap
+apart, or within --max-gap of a track point. The track logs are in UTC;
+capture times are converted using their recorded offset from UTC. For files
+without one, give the offset of the camera clock with --time-offset.`,
+    Args:        cobra.ExactArgs(1),
+    Annotations: map[string]string{libraryArgAnnotation: "0"},
+    Run: func(cmd *cobra.Command, args []string) {
+        destDir := args[0]
+        geotagLibrary(destDir)
+    },
+}
+
+var (
+    gpxFiles    []string
+    maxTrackGap time.Duration
+    timeOffset  string
+    writeXMP    bool
+)
+
+func init() {
+    rootCmd.AddCommand(geotagCmd)
+    geotagCmd.Flags().StringSliceVar(&gpxFiles, "gpx", nil, "GPX track log to match against, can be repeated")
+    geotagCmd.Flags().DurationVar(&maxTrackGap, "max-gap", 5*time.Minute, "Largest time between track points to interpolate across, and from a track point to a file")
+    geotagCmd.Flags().StringVar(&timeOffset, "time-offset", "", "Offset of the camera clock from UTC, e.g. +02:00 (default: the offset recorded for each file, or UTC)")
+    geotagCmd.Flags().BoolVar(&writeXMP, "xmp", false, "Also write the positions to XMP sidecar files next to the media files")
+    geotagCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "Show the matches without changing anything")
+    geotagCmd.Flags().StringVar(&geoNamesFile, "geonames", "", "GeoNames cities file for place names (default <archive_directory>/geonames/cities15000.txt if present)")
+}
+
+// trackPoint is a position from a GPX track log.
+type trackPoint struct {
+    time      time.Time
+    lat, long float64
+    elevation *float64
+}
+
+type gpxDocument struct {
+    Tracks []struct {
+        Segments []struct {
+            Points []struct {
+                Lat       float64  `xml:"lat,attr"`
+                Lon       float64  `xml:"lon,attr"`
+                Elevation *float64 `xml:"ele"`
+                Time      string   `xml:"time"`
+            } `xml:"trkpt"`
+        } `xml:"trkseg"`
+    } `xml:"trk"`
+}
+
+func geotagLibrary(destDir string) {
+    if len(gpxFiles) == 0 {
+        fmt.Printf("Error: at least one --gpx track log is required\n")
+        return
+    }
+    var offset *time.Location
+    if timeOffset != "" {
+        seconds, err := parseUTCOffset(timeOffset)
+        if err != nil {
+            fmt.Printf("Error: %v\n", err)
+            return
+        }
+        offset = time.FixedZone(timeOffset, seconds)
+    }
+
+    var track []trackPoint
+    for _, path := range gpxFiles {
+        points, err := readGPX(path)
+        if err != nil {
+            fmt.Printf("Error reading %s: %v\n", path, err)
+            return
+        }
+        track = append(track, points...)
+    }
+    if len(track) == 0 {
+        fmt.Printf("Error: no track points with a time found\n")
+        return
+    }
+    sort.Slice(track, func(i, j int) bool { return track[i].time.Before(track[j].time) })
+
+    db, err := initDB(destDir)
+    if err != nil {
+        fmt.Printf("Error opening database: %v\n", err)
+        return
+    }
+    defer db.Close()
+
+    if err := setupGeocoder(geoNamesFile, destDir); err != nil {
+        fmt.Printf("Error loading place names: %v\n", err)
+        return
+    }
+
+    type untagged struct {
+        id        int64
+        newPath   string
+        dateTaken time.Time
+        zoned     bool
+    }
+    // The database has a single connection, so the rows are read before
+    // any of them is updated
+    rows, err := db.Query(`SELECT id, new_path, date_taken, tz_offset IS NOT NULL FROM media
+        WHERE latitude IS NULL AND date_taken IS NOT NULL AND status = ?
+        ORDER BY date_taken`, mediaOK)
+    if err != nil {
+        fmt.Printf("Error querying database: %v\n", err)
+        return
+    }
+    var files []untagged
+    for rows.Next() {
+        var f untagged
+        if err := rows.Scan(&f.id, &f.newPath, &f.dateTaken, &f.zoned); err != nil {
+            fmt.Printf("Error scanning row: %v\n", err)
+            continue
+        }
+        files = append(files, f)
+    }
+    rows.Close()
+
+    var tagged, unmatched, unzoned, errors int
+    for _, f := range files {
+        taken := f.dateTaken
+        if offset != nil {
+            // The recorded wall clock time is local time at the offset
+            taken = withWallClock(taken, offset)
+        } else if !f.zoned {
+            unzoned++
+        }
+        point, how, ok := matchTrack(track, taken, maxTrackGap)
+        if !ok {
+            unmatched++
+            continue
+        }
+
+        var metadata MediaMetadata
+        metadata.setLocation(point.lat, point.long, point.elevation)
+        lookupPlace(&metadata)
+        description := metadata.Location
+        if place := formatPlace(metadata); place != "" {
+            description += " (" + place + ")"
+        }
+        if dryRun {
+            fmt.Printf("Would tag %s: %s, %s\n", f.newPath, description, how)
+            tagged++
+            continue
+        }
+
+        if writeXMP {
+            if err := writeXMPSidecar(f.newPath, xmpGPSProperties(point.lat, point.long, point.elevation)); err != nil {
+                fmt.Printf("Error writing XMP sidecar for %s: %v\n", f.newPath, err)
+                errors++
+                continue
+            }
+        }
+        _, err := db.Exec(`UPDATE media SET location = ?, latitude = ?, longitude = ?, altitude = ?, country = ?, region = ?, city = ? WHERE id = ?`,
+            metadata.Location, metadata.Latitude, metadata.Longitude, metadata.Altitude,
+            nullIfZero(metadata.Country), nullIfZero(metadata.Region), nullIfZero(metadata.City), f.id)
+        if err != nil {
+            fmt.Printf("Error updating record for %s: %v\n", f.newPath, err)
+            errors++
+            continue
+        }
+        fmt.Printf("Tagged %s: %s, %s\n", f.newPath, description, how)
+        tagged++
+    }
+
+    if unzoned > 0 {
+        fmt.Printf("Note: %d files have no recorded offset from UTC and were matched as UTC, use --time-offset if the camera clock was set to local time.\n", unzoned)
+    }
+    if dryRun {
+        fmt.Printf("Dry run complete. Would tag: %d, No match: %d, Errors: %d\n", tagged, unmatched, errors)
+    } else {
+        fmt.Printf("Geotag complete. Tagged: %d, No match: %d, Errors: %d\n", tagged, unmatched, errors)
+    }
+}
+
+// readGPX returns the timed track points of a GPX file.
+func readGPX(path string) ([]trackPoint, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    var doc gpxDocument
+    if err := xml.NewDecoder(file).Decode(&doc); err != nil {
+        return nil, fmt.Errorf("invalid GPX file: %w", err)
+    }
+    var points []trackPoint
+    for _, track := range doc.Tracks {
+        for _, segment := range track.Segments {
+            for _, p := range segment.Points {
+                t, err := time.Parse(time.RFC3339, strings.TrimSpace(p.Time))
+                if err != nil {
+                    continue
+                }
+                points = append(points, trackPoint{time: t, lat: p.Lat, long: p.Lon, elevation: p.Elevation})
+            }
+        }
+    }
+    return points, nil
+}
+
+// matchTrack finds the position at time t in a track sorted by time, and
+// describes how it was found.
+func matchTrack(track []trackPoint, t time.Time, maxGap time.Duration) (trackPoint, string, bool) {
+    i := sort.Search(len(track), func(i int) bool { return !track[i].time.Before(t) })
+    if i < len(track) && track[i].time.Equal(t) {
+        return track[i], "exact track point", true
+    }
+
+    if i > 0 && i < len(track) {
+        prev, next := track[i-1], track[i]
+        if gap := next.time.Sub(prev.time); gap <= maxGap {
+            fraction := float64(t.Sub(prev.time)) / float64(gap)
+            point := trackPoint{
+                time: t,
+                lat:  prev.lat + (next.lat-prev.lat)*fraction,
+                long: prev.long + (next.long-prev.long)*fraction,
+            }
+            if prev.elevation != nil && next.elevation != nil {
+                elevation := *prev.elevation + (*next.elevation-*prev.elevation)*fraction
+                point.elevation = &elevation
+            }
+            return point, fmt.Sprintf("interpolated between points %v apart", gap), true
+        }
+    }
+
+    // Outside the track or in a gap, use the nearest point if close enough
+    var nearest trackPoint
+    var distance time.Duration = -1
+    for _, j := range []int{i - 1, i} {
+        if j < 0 || j >= len(track) {
+            continue
+        }
+        d := track[j].time.Sub(t)
+        if d < 0 {
+            d = -d
+        }
+        if distance < 0 || d < distance {
+            nearest, distance = track[j], d
+        }
+    }
+    if distance < 0 || distance > maxGap {
+        return trackPoint{}, "", false
+    }
+    return nearest, fmt.Sprintf("nearest track point %v away", distance), true
+}
+
+// parseUTCOffset parses an offset from UTC such as +02:00, -0530 or +2 and
+// returns it in seconds.
+func parseUTCOffset(s string) (int, error) {
+    if s == "Z" || strings.EqualFold(s, "UTC") {
+        return 0, nil
+    }
+    invalid := fmt.Errorf("invalid UTC offset %q, expected e.g. +02:00", s)
+    if len(s) < 2 || (s[0] != '+' && s[0] != '-') {
+        return 0, invalid
+    }
+    digits := strings.Replace(s[1:], ":", "", 1)
+    var hours, minutes int
+    var err error
+    switch len(digits) {
+    case 1, 2:
+        hours, err = strconv.Atoi(digits)
+    case 4:
+        hours, err = strconv.Atoi(digits[:2])
+        if err == nil {
+            minutes, err = strconv.Atoi(digits[2:])
+        }
+    default:
+        return 0, invalid
+    }
+    if err != nil || hours > 14 || minutes > 59 {
+        return 0, invalid
+    }
+    seconds := hours*3600 + minutes*60
+    if s[0] == '-' {
+        seconds = -seconds
+    }
+    return seconds, nil
+}
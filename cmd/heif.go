@@ -0,0 +1,438 @@
+package cmd
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// Readers for image formats that image.DecodeConfig and goexif do not
+// understand: HEIF (HEIC, HIF), AVIF and WebP. Only the Exif block and the
+// image dimensions are extracted, the image data itself is never decoded.
+
+// containerImage is what was found in a HEIF or WebP file. exif holds the
+// raw TIFF structure of the Exif block, if there is one.
+type containerImage struct {
+    exif   []byte
+    width  int
+    height int
+}
+
+// isContainerImage reports whether the file needs readContainerImage.
+func isContainerImage(path string) bool {
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".heic", ".heif", ".hif", ".avif", ".webp":
+        return true
+    }
+    return false
+}
+
+func readContainerImage(path string) (result containerImage, err error) {
+    // The parsers index into data read from the file; a damaged file must
+    // not take the whole import down with it
+    defer func() {
+        if r := recover(); r != nil {
+            result, err = containerImage{}, fmt.Errorf("invalid image data: %v", r)
+        }
+    }()
+    file, err := os.Open(path)
+    if err != nil {
+        return containerImage{}, err
+    }
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil {
+        return containerImage{}, err
+    }
+    if strings.ToLower(filepath.Ext(path)) == ".webp" {
+        return readWebP(file, info.Size())
+    }
+    return readHEIF(file, info.Size())
+}
+
+// heifExtent is a piece of an item's data in a HEIF file, as read from the
+// file and not yet checked against its size.
+type heifExtent struct {
+    offset uint64
+    length uint64
+}
+
+// readHEIF reads the meta box of a HEIF or AVIF file: the Exif item from
+// iinf and iloc, and the size of the primary image from its ispe property.
+func readHEIF(r io.ReaderAt, size int64) (containerImage, error) {
+    var result containerImage
+    var meta *mp4Box
+    err := readBoxes(r, 0, size, func(box mp4Box) error {
+        if box.boxType == "meta" && meta == nil {
+            b := box
+            meta = &b
+        }
+        return nil
+    })
+    if err != nil {
+        return result, err
+    }
+    if meta == nil {
+        return result, fmt.Errorf("no meta box found")
+    }
+
+    var primaryID uint32
+    var exifID uint32
+    var locations map[uint32][]heifExtent
+    var properties [][]byte              // ispe payloads by 1-based ipco index, nil for other properties
+    associations := map[uint32][]int{} // item ID -> property indexes
+    // meta is a full box, its children start after version and flags
+    err = readBoxes(r, meta.start+4, meta.end, func(box mp4Box) error {
+        switch box.boxType {
+        case "pitm":
+            data, err := readBoxData(r, box)
+            if err != nil {
+                return err
+            }
+            if len(data) >= 6 && data[0] == 0 {
+                primaryID = uint32(binary.BigEndian.Uint16(data[4:6]))
+            } else if len(data) >= 8 {
+                primaryID = binary.BigEndian.Uint32(data[4:8])
+            }
+        case "iinf":
+            data, err := readBoxData(r, box)
+            if err != nil {
+                return err
+            }
+            exifID, err = findExifItem(data)
+            return err
+        case "iloc":
+            data, err := readBoxData(r, box)
+            if err != nil {
+                return err
+            }
+            locations, err = parseIloc(data)
+            return err
+        case "iprp":
+            return readBoxes(r, box.start, box.end, func(child mp4Box) error {
+                switch child.boxType {
+                case "ipco":
+                    return readBoxes(r, child.start, child.end, func(property mp4Box) error {
+                        var data []byte
+                        if property.boxType == "ispe" {
+                            var err error
+                            if data, err = readBoxData(r, property); err != nil {
+                                return err
+                            }
+                        }
+                        properties = append(properties, data)
+                        return nil
+                    })
+                case "ipma":
+                    data, err := readBoxData(r, child)
+                    if err != nil {
+                        return err
+                    }
+                    parseIpma(data, associations)
+                }
+                return nil
+            })
+        }
+        return nil
+    })
+    if err != nil {
+        return result, err
+    }
+
+    // The size of the primary item, or the largest size if it has none
+    for _, index := range associations[primaryID] {
+        if w, h, ok := parseIspe(properties, index); ok {
+            result.width, result.height = w, h
+            break
+        }
+    }
+    if result.width == 0 {
+        for index := range properties {
+            if w, h, ok := parseIspe(properties, index+1); ok && w*h > result.width*result.height {
+                result.width, result.height = w, h
+            }
+        }
+    }
+
+    if extents, ok := locations[exifID]; ok && exifID != 0 {
+        var data []byte
+        var total uint64
+        for _, extent := range extents {
+            total += extent.length
+            if extent.length == 0 || total > maxMetaBoxSize || extent.offset > uint64(size) ||
+                extent.length > uint64(size)-extent.offset {
+                return result, fmt.Errorf("invalid Exif item location")
+            }
+            chunk := make([]byte, extent.length)
+            if _, err := r.ReadAt(chunk, int64(extent.offset)); err != nil {
+                return result, err
+            }
+            data = append(data, chunk...)
+        }
+        // The item starts with the offset of the TIFF header, which
+        // usually follows an "Exif\0\0" marker
+        if len(data) >= 4 {
+            start := 4 + int(binary.BigEndian.Uint32(data[:4]))
+            if start < len(data) {
+                result.exif = data[start:]
+            }
+        }
+    }
+    return result, nil
+}
+
+// findExifItem returns the ID of the Exif item listed in an iinf box.
+func findExifItem(data []byte) (uint32, error) {
+    if len(data) < 6 {
+        return 0, fmt.Errorf("invalid iinf box")
+    }
+    offset := 6
+    if data[0] != 0 {
+        offset = 8
+    }
+    var exifID uint32
+    err := readBoxes(bytes.NewReader(data), int64(offset), int64(len(data)), func(box mp4Box) error {
+        if box.boxType != "infe" || exifID != 0 {
+            return nil
+        }
+        if box.start < 0 || box.start > box.end || box.end > int64(len(data)) {
+            return fmt.Errorf("invalid infe box")
+        }
+        infe := data[box.start:box.end]
+        // Only versions 2 and 3 carry an item type
+        switch {
+        case len(infe) >= 12 && infe[0] == 2:
+            if string(infe[8:12]) == "Exif" {
+                exifID = uint32(binary.BigEndian.Uint16(infe[4:6]))
+            }
+        case len(infe) >= 14 && infe[0] == 3:
+            if string(infe[10:14]) == "Exif" {
+                exifID = binary.BigEndian.Uint32(infe[4:8])
+            }
+        }
+        return nil
+    })
+    return exifID, err
+}
+
+// parseIloc returns the extents of every item with data in the file.
+func parseIloc(data []byte) (map[uint32][]heifExtent, error) {
+    errInvalid := fmt.Errorf("invalid iloc box")
+    if len(data) < 8 {
+        return nil, errInvalid
+    }
+    version := data[0]
+    offsetSize := int(data[4] >> 4)
+    lengthSize := int(data[4] & 0xf)
+    baseOffsetSize := int(data[5] >> 4)
+    indexSize := 0
+    if version == 1 || version == 2 {
+        indexSize = int(data[5] & 0xf)
+    }
+    pos := 6
+    read := func(n int) (uint64, bool) {
+        if pos+n > len(data) {
+            return 0, false
+        }
+        var v uint64
+        for _, b := range data[pos : pos+n] {
+            v = v<<8 | uint64(b)
+        }
+        pos += n
+        return v, true
+    }
+
+    idSize := 2
+    if version == 2 {
+        idSize = 4
+    }
+    count, ok := read(idSize)
+    if !ok {
+        return nil, errInvalid
+    }
+    locations := make(map[uint32][]heifExtent)
+    for i := uint64(0); i < count; i++ {
+        id, ok := read(idSize)
+        if !ok {
+            return nil, errInvalid
+        }
+        constructionMethod := uint64(0)
+        if version == 1 || version == 2 {
+            if constructionMethod, ok = read(2); !ok {
+                return nil, errInvalid
+            }
+            constructionMethod &= 0xf
+        }
+        read(2) // data reference index
+        baseOffset, _ := read(baseOffsetSize)
+        extentCount, ok := read(2)
+        if !ok {
+            return nil, errInvalid
+        }
+        var extents []heifExtent
+        for j := uint64(0); j < extentCount; j++ {
+            read(indexSize)
+            offset, ok1 := read(offsetSize)
+            length, ok2 := read(lengthSize)
+            if !ok1 || !ok2 {
+                return nil, errInvalid
+            }
+            if baseOffset+offset < baseOffset {
+                return nil, errInvalid
+            }
+            extents = append(extents, heifExtent{offset: baseOffset + offset, length: length})
+        }
+        // Only data stored at file offsets is of interest
+        if constructionMethod == 0 {
+            locations[uint32(id)] = extents
+        }
+    }
+    return locations, nil
+}
+
+// parseIpma adds the property indexes of each item to associations.
+func parseIpma(data []byte, associations map[uint32][]int) {
+    if len(data) < 8 {
+        return
+    }
+    version := data[0]
+    largeIndexes := data[3]&1 != 0
+    count := int(binary.BigEndian.Uint32(data[4:8]))
+    pos := 8
+    for i := 0; i < count; i++ {
+        var id uint32
+        if version < 1 {
+            if pos+2 > len(data) {
+                return
+            }
+            id = uint32(binary.BigEndian.Uint16(data[pos:]))
+            pos += 2
+        } else {
+            if pos+4 > len(data) {
+                return
+            }
+            id = binary.BigEndian.Uint32(data[pos:])
+            pos += 4
+        }
+        if pos >= len(data) {
+            return
+        }
+        n := int(data[pos])
+        pos++
+        for j := 0; j < n; j++ {
+            var index int
+            if largeIndexes {
+                if pos+2 > len(data) {
+                    return
+                }
+                index = int(binary.BigEndian.Uint16(data[pos:]) & 0x7fff)
+                pos += 2
+            } else {
+                if pos >= len(data) {
+                    return
+                }
+                index = int(data[pos] & 0x7f)
+                pos++
+            }
+            associations[id] = append(associations[id], index)
+        }
+    }
+}
+
+// parseIspe returns the size from the ispe property at a 1-based index.
+func parseIspe(properties [][]byte, index int) (int, int, bool) {
+    if index < 1 || index > len(properties) {
+        return 0, 0, false
+    }
+    data := properties[index-1]
+    if len(data) < 12 {
+        return 0, 0, false
+    }
+    return int(binary.BigEndian.Uint32(data[4:8])), int(binary.BigEndian.Uint32(data[8:12])), true
+}
+
+// readWebP reads the RIFF chunks of a WebP file for the canvas size and
+// the EXIF chunk.
+func readWebP(r io.ReaderAt, size int64) (containerImage, error) {
+    var result containerImage
+    header := make([]byte, 12)
+    if _, err := r.ReadAt(header, 0); err != nil {
+        return result, err
+    }
+    if string(header[:4]) != "RIFF" || string(header[8:12]) != "WEBP" {
+        return result, fmt.Errorf("not a WebP file")
+    }
+    chunk := make([]byte, 8)
+    for offset := int64(12); offset+8 <= size; {
+        if _, err := r.ReadAt(chunk, offset); err != nil {
+            return result, err
+        }
+        chunkType := string(chunk[:4])
+        chunkSize := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+        start := offset + 8
+        if start+chunkSize > size {
+            return result, fmt.Errorf("invalid %q chunk", chunkType)
+        }
+        switch chunkType {
+        case "VP8X", "VP8 ", "VP8L":
+            if result.width != 0 {
+                break
+            }
+            data := make([]byte, min64(chunkSize, 10))
+            if _, err := r.ReadAt(data, start); err != nil {
+                return result, err
+            }
+            result.width, result.height = webPSize(chunkType, data)
+        case "EXIF":
+            if chunkSize > maxMetaBoxSize {
+                return result, fmt.Errorf("EXIF chunk too large")
+            }
+            data := make([]byte, chunkSize)
+            if _, err := r.ReadAt(data, start); err != nil {
+                return result, err
+            }
+            // Some writers keep the JPEG style marker
+            result.exif = bytes.TrimPrefix(data, []byte("Exif\x00\x00"))
+        }
+        // Chunks are padded to an even size
+        offset = start + chunkSize + chunkSize&1
+    }
+    return result, nil
+}
+
+func webPSize(chunkType string, data []byte) (int, int) {
+    switch chunkType {
+    case "VP8X":
+        // 24 bit canvas width and height minus one, after the flags
+        if len(data) >= 10 {
+            w := int(data[4]) | int(data[5])<<8 | int(data[6])<<16
+            h := int(data[7]) | int(data[8])<<8 | int(data[9])<<16
+            return w + 1, h + 1
+        }
+    case "VP8 ":
+        // A frame tag and start code precede two 14 bit sizes
+        if len(data) >= 10 && data[3] == 0x9d && data[4] == 0x01 && data[5] == 0x2a {
+            w := int(binary.LittleEndian.Uint16(data[6:8]) & 0x3fff)
+            h := int(binary.LittleEndian.Uint16(data[8:10]) & 0x3fff)
+            return w, h
+        }
+    case "VP8L":
+        // A signature byte, then 14 bit width and height minus one
+        if len(data) >= 5 && data[0] == 0x2f {
+            bits := binary.LittleEndian.Uint32(data[1:5])
+            return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1
+        }
+    }
+    return 0, 0
+}
+
+func min64(a, b int64) int64 {
+    if a < b {
+        return a
+    }
+    return b
+}
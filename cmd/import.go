@@ -14,7 +14,6 @@ import (
     "time"
     "github.com/spf13/cobra"
     _ "github.com/mattn/go-sqlite3"
-    "archive/zip"
     "log"
 )
 
@@ -24,14 +23,19 @@ type ImportResult struct {
     OriginalPath string
     NewPath      string
     InDatabase    bool
+    Sidecars     []string // library paths of the sidecars placed with the file
 }
 
 type ImportStats struct {
+    mu               sync.Mutex
     Imported         int
     ImportedExisting int
     SkippedInDB      int
     SkippedSmall     int
+    SkippedPair      int
     NonMedia         int
+    Resumed          int
+    Sidecars         int
     Errors           int
 }
 
@@ -40,9 +44,26 @@ type ImportStats struct {
 var importCmd = &cobra.Command{
     Use:   "import [source_directory] [destination_directory]",
     Short: "Import and organize images into a new directory structure",
-    Long:  `Import images from the source directory and organize them into a new directory structure based on their EXIF date.`,
-    Args:  cobra.ExactArgs(2),
+    Long:  `Import images from the source directory and organize them into a new directory structure based on their EXIF date.
+
+Every import is recorded as a session in media.db. An interrupted import can
+be continued with "import --resume <session> [destination_directory]".`,
+    Args: func(cmd *cobra.Command, args []string) error {
+        if resumeID != 0 {
+            return cobra.ExactArgs(1)(cmd, args)
+        }
+        return cobra.ExactArgs(2)(cmd, args)
+    },
+    Annotations: map[string]string{libraryArgAnnotation: "-1"},
     Run: func(cmd *cobra.Command, args []string) {
+        // Moving deletes the source, so make sure the copy is good first
+        if moveFiles && !cmd.Flags().Changed("verify") {
+            verifyCopies = true
+        }
+        if resumeID != 0 {
+            importImages("", args[0])
+            return
+        }
         sourceDir := args[0]
         destDir := args[1]
         importImages(sourceDir, destDir)
@@ -51,36 +72,98 @@ var importCmd = &cobra.Command{
 var (
     minDimension int
     moveFiles    bool    
+    verifyCopies bool
+    workers      int
+    layoutTemplate string
+    geoNamesFile   string
+    destLayout   *pathLayout
     logFile      *os.File
-    logger       *log.Logger
+    logger       = log.New(io.Discard, "", log.LstdFlags)
+
+    // plannedPaths holds the destinations chosen so far during a dry run, so
+    // that name collisions between planned files are resolved like real ones.
+    plannedPaths map[string]bool
+
+    resumeID       int64
+    currentSession *importSession
 )
 func init() {  
    rootCmd.AddCommand(importCmd)
    importCmd.Flags().IntVar(&minDimension, "min-dimension", 0, "Minimum dimension (width or height) for imported images. 0 means no limit.")
    importCmd.Flags().BoolVar(&moveFiles, "move", false, "Move files instead of copying")
+   importCmd.Flags().BoolVar(&verifyCopies, "verify", false, "Re-read every copied file and compare its hash before accepting it (default true with --move)")
+   importCmd.Flags().IntVarP(&workers, "workers", "w", 1, "Number of parallel workers for hashing and metadata extraction. 0 means one per CPU.")
+   importCmd.Flags().StringVar(&layoutTemplate, "layout", defaultLayout, "Destination path template, e.g. {year}/{year}-{month}-{day}/{camera_model}/{basename}")
+   importCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "Print the planned action for each file without touching the destination or the database")
+   importCmd.Flags().Int64Var(&resumeID, "resume", 0, "Resume the interrupted import session with this id")
+   importCmd.Flags().StringVar(&defaultTZ, "default-tz", "", "Time zone of cameras that do not record one, e.g. Europe/Helsinki or +02:00")
+   importCmd.Flags().StringToStringVar(&cameraTZ, "camera-tz", nil, "Time zone per camera model, e.g. \"Canon EOS R6=Europe/Helsinki\"")
+   importCmd.Flags().StringSliceVar(&datePatternFlags, "date-pattern", nil, "Extra regular expression for dates in file and folder names, with (?P<year>), (?P<month>) and (?P<day>) groups and optionally hour, minute and second; can be repeated")
+   importCmd.Flags().StringVar(&pairMode, "pairs", pairsSplit, "Handling of RAW+JPEG pairs: split (RAW and JPEG in their own trees), side-by-side (JPEG placed with its RAW) or skip-jpeg")
+   importCmd.Flags().BoolVar(&takeoutMode, "takeout", false, "Source is a Google Takeout export: read capture times, positions, descriptions and people from its JSON files")
+   importCmd.Flags().BoolVar(&extractMotion, "extract-motion", false, "Extract the video of Google and Samsung motion photos into an MP4 file next to the JPEG")
+   importCmd.Flags().StringVar(&geoNamesFile, "geonames", "", "GeoNames cities file for place names (default <destination>/geonames/cities15000.txt if present)")
 
 }
 
 func importImages(sourceDir, destDir string) {
-    timestamp := time.Now().Format("2006-01-02_15-04-05")
-    logFileName := fmt.Sprintf("import_%s.log", timestamp)
-    logFilePath := filepath.Join(destDir, logFileName)
-
-    logFile, err := os.Create(logFilePath)
+    var err error
+    destLayout, err = parseLayout(layoutTemplate)
     if err != nil {
-        fmt.Printf("Error creating log file: %v\n", err)
+        fmt.Printf("Error in layout: %v\n", err)
         return
     }
-    defer logFile.Close()
+    if err := checkPairMode(pairMode); err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    if err := setupGeocoder(geoNamesFile, destDir); err != nil {
+        fmt.Printf("Error loading place names: %v\n", err)
+        return
+    }
+    if err := setupTimeZones(defaultTZ, cameraTZ); err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    if err := setupDatePatterns(datePatternFlags); err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+
+    var logOutput io.Writer = io.Discard
+    if !dryRun {
+        timestamp := time.Now().Format("2006-01-02_15-04-05")
+        logFileName := fmt.Sprintf("import_%s.log", timestamp)
+        logFilePath := filepath.Join(destDir, logFileName)
+
+        logFile, err := os.Create(logFilePath)
+        if err != nil {
+            fmt.Printf("Error creating log file: %v\n", err)
+            return
+        }
+        defer logFile.Close()
+        logOutput = logFile
+    }
     
-    logger = log.New(logFile, "", log.LstdFlags)
+    logger = log.New(logOutput, "", log.LstdFlags)
     
     logger.Printf("Import session started at %s\n", time.Now().Format(time.RFC3339))
-    logger.Printf("Source directory: %s\n", sourceDir)
-    logger.Printf("Destination directory: %s\n", destDir)
 
-    
-    db, err := initDB(destDir)
+    var db *sql.DB
+    if dryRun && resumeID != 0 {
+        fmt.Println("Error: --dry-run can not be combined with --resume")
+        return
+    }
+    if dryRun {
+        var dbPath string
+        db, dbPath, err = openDryRunDB(destDir)
+        if err == nil {
+            defer os.Remove(dbPath)
+        }
+        plannedPaths = make(map[string]bool)
+    } else {
+        db, err = initDB(destDir)
+    }
     if err != nil {
         logger.Printf("Error initializing database: %v\n", err)
         fmt.Printf("Error initializing database: %v\n", err)
@@ -88,6 +171,39 @@ func importImages(sourceDir, destDir string) {
     }
     defer db.Close()
 
+    if !dryRun {
+        finalized, removed, err := repairPendingMedia(db)
+        if err != nil {
+            logger.Printf("Error repairing unfinished imports: %v\n", err)
+            fmt.Printf("Error repairing unfinished imports: %v\n", err)
+            return
+        }
+        if finalized+removed > 0 {
+            fmt.Printf("Repaired unfinished imports from earlier sessions: %d completed, %d rolled back\n", finalized, removed)
+        }
+        // Archive members left over from an interrupted import
+        if err := removeStaleStaging(db, destDir); err != nil {
+            logger.Printf("Warning: Could not clean up the staging folder: %v\n", err)
+            fmt.Printf("Warning: could not clean up the staging folder: %v\n", err)
+        }
+
+        if resumeID != 0 {
+            currentSession, err = resumeSession(db, resumeID)
+        } else {
+            currentSession, err = startSession(db, sourceDir)
+        }
+        if err != nil {
+            logger.Printf("Error: %v\n", err)
+            fmt.Printf("Error: %v\n", err)
+            return
+        }
+        sourceDir = currentSession.sourceDir
+        logger.Printf("Session: %d\n", currentSession.id)
+    }
+    logger.Printf("Source directory: %s\n", sourceDir)
+    logger.Printf("Destination directory: %s\n", destDir)
+    logger.Printf("Layout: %s\n", layoutTemplate)
+
     ctx, cancel := context.WithCancel(context.Background())
     defer cancel()
 
@@ -110,10 +226,20 @@ func importImages(sourceDir, destDir string) {
     }()
     
 
+    if takeoutMode {
+        fmt.Println("Reading Takeout JSON files from archives...")
+        scanTakeoutArchives(sourceDir)
+    }
+
     var stats ImportStats
+    pipeline := newImportPipeline(ctx, destDir, db, &stats, workers)
 
     err = filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
         if err != nil {
+            if os.IsNotExist(err) && isSidecarFile(path) {
+                // Moved along with its media file
+                return nil
+            }
             return err
         }
 
@@ -122,25 +248,33 @@ func importImages(sourceDir, destDir string) {
             return context.Canceled
         default:
             if info.IsDir() {
+                if info.Name() == stagingDirName {
+                    // Archive members being imported
+                    return filepath.SkipDir
+                }
                 return nil
             }
 
-            if filepath.Ext(path) == ".zip" {
-                err = processZipFile(ctx, path, destDir, db, &stats)
+            if archiveKind(path) != "" {
+                err = processArchive(ctx, path, path, 0, pipeline)
                 if err != nil {
                     if err == context.Canceled {
                         return err
                     }   
-                    logger.Printf("Error processing zip file %s: %v\n", path, err)
-                    stats.Errors++
+                    logger.Printf("Error processing archive %s: %v\n", path, err)
+                    stats.countError()
                 }
-            } else {
-                processFile(path, destDir, db, &stats)
+                return nil
             }
-
-            return nil
+            return processFile(path, info, pipeline)
         }
     })
+    pipeline.wait()
+    if err == nil && len(pipeline.lateTakeout) > 0 {
+        if updated := applyLateTakeout(db, destDir, pipeline.lateTakeout); updated > 0 {
+            fmt.Printf("\nAdded metadata from Takeout JSON files of later archives to %d files\n", updated)
+        }
+    }
 
     if err != nil {
         if err == context.Canceled {
@@ -150,9 +284,41 @@ func importImages(sourceDir, destDir string) {
             logger.Printf("Error walking through directory: %v\n", err)
             fmt.Printf("Error walking through directory: %v\n", err)
         }
+        currentSession.finish("interrupted")
+    } else {
+        currentSession.finish("completed")
     }
     stats.logSummary()
     stats.printSummary()
+    if err != nil && currentSession != nil {
+        fmt.Printf("Resume with: picmover import --resume %d %s\n", currentSession.id, destDir)
+    }
+    if dryRun {
+        fmt.Println("Dry run: no files were copied and the database was not modified.")
+    }
+}
+
+// printPlan prints the planned action for a file during a dry run.
+func printPlan(result ImportResult) {
+    switch result.Status {
+    case "imported":
+        fmt.Printf("import     %s -> %s\n", result.OriginalPath, result.NewPath)
+        for _, sidecar := range result.Sidecars {
+            fmt.Printf("  sidecar  %s\n", sidecar)
+        }
+    case "imported_existing":
+        fmt.Printf("register   %s\n", result.OriginalPath)
+    case "skipped_in_db":
+        fmt.Printf("skip       %s (%s)\n", result.OriginalPath, result.Message)
+    case "skipped_small":
+        fmt.Printf("skip       %s (%s)\n", result.OriginalPath, result.Message)
+    case "skipped_pair":
+        fmt.Printf("skip       %s (%s)\n", result.OriginalPath, result.Message)
+    case "non_media":
+        fmt.Printf("skip       %s (%s)\n", result.OriginalPath, result.Message)
+    case "error":
+        fmt.Printf("error      %s (%s)\n", result.OriginalPath, result.Message)
+    }
 }
 
 func (s *ImportStats) logSummary() {
@@ -161,7 +327,10 @@ func (s *ImportStats) logSummary() {
     logger.Printf("Imported Existing: %d\n", s.ImportedExisting)
     logger.Printf("Skipped (in DB): %d\n", s.SkippedInDB)
     logger.Printf("Skipped (too small): %d\n", s.SkippedSmall)
+    logger.Printf("Skipped (JPEG of RAW): %d\n", s.SkippedPair)
     logger.Printf("Skipped (not media file): %d\n", s.NonMedia)
+    logger.Printf("Skipped (done in earlier run): %d\n", s.Resumed)
+    logger.Printf("Sidecars: %d\n", s.Sidecars)
     logger.Printf("Errors: %d\n", s.Errors)
 }
 
@@ -171,104 +340,49 @@ func (s *ImportStats) printSummary() {
     fmt.Printf("Imported Existing: %d\n", s.ImportedExisting)
     fmt.Printf("Skipped (in DB): %d\n", s.SkippedInDB)
     fmt.Printf("Skipped (too small): %d\n", s.SkippedSmall)
+    fmt.Printf("Skipped (JPEG of RAW): %d\n", s.SkippedPair)
     fmt.Printf("Skipped (not media file): %d\n", s.NonMedia)
+    fmt.Printf("Skipped (done in earlier run): %d\n", s.Resumed)
+    fmt.Printf("Sidecars: %d\n", s.Sidecars)
     fmt.Printf("Errors: %d\n", s.Errors)
 }
 
-func (s *ImportStats) updateDisplay() {
-    // Clear the current line and move cursor to beginning
-    fmt.Print("\033[2K\r")
-    fmt.Printf("Imported: %d | Imported Existing: %d | Skipped (in DB): %d | Skipped (small): %d | Non-media: %d | Errors: %d",
-        s.Imported, s.ImportedExisting, s.SkippedInDB, s.SkippedSmall, s.NonMedia, s.Errors)
+func (s *ImportStats) countResumed() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.Resumed++
+    s.updateDisplay()
 }
 
-
-
-func processZipFile(ctx context.Context, zipPath, destDir string, db *sql.DB, stats *ImportStats) error {
-    reader, err := zip.OpenReader(zipPath)
-    if err != nil {
-        return err
-    }
-    defer reader.Close()
-    // Use the zip file name as the temp folder name
-    zipBaseName := filepath.Base(zipPath)
-    tempDir, err := os.MkdirTemp("", fmt.Sprintf("%s_", zipBaseName))
-
-    if err != nil {
-        return fmt.Errorf("failed to create temp directory: %w", err)
-    }
-    defer os.RemoveAll(tempDir) // Clean up temp directory when done
-
-    for _, file := range reader.File {
-        select {
-        case <-ctx.Done():
-            return context.Canceled
-        default:
-            if file.FileInfo().IsDir() {
-                continue
-            }
-
-            err := extractAndProcessFile(file, tempDir, destDir, db, stats)
-            if err != nil {
-                logger.Printf("Error processing file %s from zip: %v\n", file.Name, err)
-                fmt.Printf("Error processing file %s from zip: %v\n", file.Name, err)
-                stats.Errors++
-            }
-            stats.updateDisplay()
-        }
+func (s *ImportStats) countError() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.Errors++
+    if !dryRun {
+        s.updateDisplay()
     }
-
-    return nil
 }
 
-
-func extractAndProcessFile(file *zip.File, tempDir, destDir string, db *sql.DB, stats *ImportStats) error {
-    // Create a temporary file with the original name
-    tempFilePath := filepath.Join(tempDir, filepath.Base(file.Name))
-    tempFile, err := os.Create(tempFilePath)
-    if err != nil {
-        return fmt.Errorf("failed to create temp file: %w", err)
-    }
-    defer tempFile.Close()
-    defer os.Remove(tempFilePath) // Clean up temp file when done
-
-    // Extract the file
-    zippedFile, err := file.Open()
-    if err != nil {
-        return fmt.Errorf("failed to open zipped file: %w", err)
-    }
-    defer zippedFile.Close()
-
-    _, err = io.Copy(tempFile, zippedFile)
-    if err != nil {
-        return fmt.Errorf("failed to extract file: %w", err)
-    }
-
-    // Ensure all data is written to disk
-    err = tempFile.Sync()
-    if err != nil {
-        return fmt.Errorf("failed to sync temp file: %w", err)
-    }
-
-    // Close the file to ensure we can modify its timestamps
-    tempFile.Close()
-
-    // Set the modification time of the temporary file to match the original file in the ZIP
-    err = os.Chtimes(tempFilePath, time.Now(), file.Modified)
-    if err != nil {
-        return fmt.Errorf("failed to set file times: %w", err)
-    }
-
-    // Process the extracted file
-    result := processAndMoveMedia(tempFilePath, destDir, db)
-    updateStats(result, stats)
-    stats.updateDisplay()
-    return nil
+// updateDisplay must be called with s.mu held.
+func (s *ImportStats) updateDisplay() {
+    // Clear the current line and move cursor to beginning
+    fmt.Print("\033[2K\r")
+    fmt.Printf("Imported: %d | Imported Existing: %d | Skipped (in DB): %d | Skipped (small): %d | Skipped (JPEG of RAW): %d | Non-media: %d | Resumed: %d | Errors: %d",
+        s.Imported, s.ImportedExisting, s.SkippedInDB, s.SkippedSmall, s.SkippedPair, s.NonMedia, s.Resumed, s.Errors)
 }
 
 
 
 func updateStats(result ImportResult, stats *ImportStats) {
+    stats.mu.Lock()
+    defer stats.mu.Unlock()
+    if dryRun {
+        printPlan(result)
+    } else {
+        defer stats.updateDisplay()
+    }
+
+    stats.Sidecars += len(result.Sidecars)
     switch result.Status {
     case "imported":
         logger.Printf("Imported: %s -> %s\n", result.OriginalPath, result.NewPath)
@@ -282,6 +396,9 @@ func updateStats(result ImportResult, stats *ImportStats) {
     case "skipped_small":
         logger.Printf("Skipped (too small): %s (%s)\n", result.OriginalPath, result.Message)
         stats.SkippedSmall++
+    case "skipped_pair":
+        logger.Printf("Skipped (JPEG of RAW): %s (%s)\n", result.OriginalPath, result.Message)
+        stats.SkippedPair++
     case "non_media":
         logger.Printf("Skipped (non media): %s (%s)\n", result.OriginalPath, result.Message)
         stats.NonMedia++
@@ -291,66 +408,215 @@ func updateStats(result ImportResult, stats *ImportStats) {
     }
 }
 
-func processFile(path, destDir string, db *sql.DB, stats *ImportStats) {
+func processFile(path string, info os.FileInfo, pipeline *importPipeline) error {
     if _, isMedia := isMediaFile(path); isMedia {
-        result := processAndMoveMedia(path, destDir, db)
-        updateStats(result, stats)
-        stats.updateDisplay()
-
+        file := newSourceFile(path, info)
+        if currentSession.isDone(file) {
+            pipeline.stats.countResumed()
+            return nil
+        }
+        return pipeline.submit(importJob{sourcePath: path, file: file})
+    }
+    if isSidecarFile(path) && hasSidecarOwner(path) {
+        // Imported together with its media file
+        return nil
     }
+    if takeoutMode && isTakeoutJSON(path) {
+        // Read with the media files
+        return nil
+    }
+    updateStats(ImportResult{Status: "non_media", Message: "Not a supported media file", OriginalPath: path}, pipeline.stats)
+    return nil
 }
 
 
+// processAndMoveMedia imports a single file synchronously. It must not be
+// used concurrently with an import pipeline writing to the same database.
 func processAndMoveMedia(sourcePath, destDir string, db *sql.DB) ImportResult {
+    job := importJob{sourcePath: sourcePath, file: sourceFile{key: sourcePath}}
+    return commitMedia(prepareMedia(job, db), destDir, db)
+}
+
+// adoptMedia adds a file that is already inside the library to the database
+// where it is, like an import that finds the file at its destination.
+func adoptMedia(path, destDir string, db *sql.DB) ImportResult {
+    job := importJob{sourcePath: path, file: sourceFile{key: path}, inPlace: true}
+    return commitMedia(prepareMedia(job, db), destDir, db)
+}
+
+
+// prepareMedia does the expensive, read-only part of an import: hashing,
+// duplicate lookup, metadata extraction and size filtering. It is safe to
+// call from several goroutines.
+func prepareMedia(job importJob, db *sql.DB) preparedMedia {
+    sourcePath := job.sourcePath
+    prepared := preparedMedia{sourcePath: sourcePath, file: job.file, inPlace: job.inPlace, staged: job.staged, archive: job.archive}
+    if job.staged {
+        // The staged file is only a temporary copy of the archive member
+        prepared.originalPath = job.file.key
+    }
     fileType, isMedia := isMediaFile(sourcePath)
     if !isMedia {
-        return ImportResult{Status: "non_media", Message: "Not a supported media file", OriginalPath: sourcePath}
+        return prepared.resolve(ImportResult{Status: "non_media", Message: "Not a supported media file", OriginalPath: sourcePath})
     }
-    hash, err := computeXXHash(sourcePath)
-    if err != nil {
-        return ImportResult{Status: "error", Message: fmt.Sprintf("Error computing hash: %v", err), OriginalPath: sourcePath}
+    prepared.fileType = fileType
+
+    // A resumed session already knows the hash of files it got to before
+    hash := job.hash
+    if entry, ok := currentSession.lookup(job.file); ok && hash == 0 {
+        hash = entry.hash
     }
-    isDuplicate, existingPath, err := checkDuplicate(db, hash)
-    if err != nil {
-        return ImportResult{Status: "error", Message: fmt.Sprintf("Error checking for duplicates: %v", err), OriginalPath: sourcePath}
+    if hash == 0 {
+        var err error
+        hash, err = computeXXHash(sourcePath)
+        if err != nil {
+            return prepared.resolve(ImportResult{Status: "error", Message: fmt.Sprintf("Error computing hash: %v", err), OriginalPath: sourcePath})
+        }
     }
+    prepared.hash = hash
 
-    if isDuplicate {
-        return ImportResult{
-            Status:       "skipped_in_db",
-            Message:      fmt.Sprintf("Duplicate media found in database. Hash: %x, Existing file: %s", hash, existingPath),
-            OriginalPath: sourcePath,
-            InDatabase:   true,
-        }
+    if result, isDuplicate := duplicateResult(db, sourcePath, hash); isDuplicate {
+        return prepared.resolve(result)
     }
-  
 
-    metadata, err := getMediaMetadata(sourcePath)
+    // Archive members are extracted under a temporary name, their dates are
+    // looked for in the name within the archive
+    name := job.file.key
+    if name == "" {
+        name = sourcePath
+    }
+    metadata, err := readMediaMetadata(sourcePath, name, job.head)
     if err != nil {
-        return ImportResult{Status: "error", Message: fmt.Sprintf("Error reading metadata: %v", err), OriginalPath: sourcePath}
+        return prepared.resolve(ImportResult{Status: "error", Message: fmt.Sprintf("Error reading metadata: %v", err), OriginalPath: sourcePath})
+    }
+    if takeoutMode && !applyTakeoutMetadata(sourcePath, job.file.key, &metadata) && job.archive != "" {
+        prepared.noTakeout = true
     }
+    prepared.metadata = metadata
 
     // Check dimensions for images
     if fileType == "image" && minDimension > 0 {
         width, height, err := parseResolution(metadata.Resolution)
         if err != nil {
-            return ImportResult{Status: "error", Message: fmt.Sprintf("Error parsing resolution: %v", err), OriginalPath: sourcePath}
+            return prepared.resolve(ImportResult{Status: "error", Message: fmt.Sprintf("Error parsing resolution: %v", err), OriginalPath: sourcePath})
         }
         if width < minDimension && height < minDimension {
-            return ImportResult{
+            return prepared.resolve(ImportResult{
                 Status:       "skipped_small",
                 Message:      fmt.Sprintf("Image dimensions (%dx%d) smaller than minimum (%dx%d)", width, height, minDimension, minDimension),
                 OriginalPath: sourcePath,
-            }
+            })
         }
     }
-   
 
-    
+    // The RAW half of a pair may not have been imported yet
+    if fileType == "image" && pairMode != pairsSplit {
+        prepared.rawSibling, _ = findRawSibling(sourcePath, metadata)
+    }
+    prepared.sidecars = findSidecars(sourcePath)
+
+    // The still of a Live Photo may not have been imported yet
+    switch fileType {
+    case "video":
+        prepared.still, _ = findLiveStill(sourcePath, metadata)
+    case "image":
+        prepared.motion, _ = findEmbeddedVideo(sourcePath)
+    }
+    return prepared
+}
+
+
+// commitMedia places a prepared file in the library and records it in the
+// database. It is only ever called from a single goroutine.
+func commitMedia(prepared preparedMedia, destDir string, db *sql.DB) ImportResult {
+    result := placeMedia(prepared, destDir, db)
+    // Sidecars of a file that is already in the library, such as an XMP file
+    // Lightroom wrote after it was imported, are added to the library copy
+    if result.Status == "skipped_in_db" && !prepared.staged && !prepared.inPlace {
+        result.Sidecars = attachSidecars(db, prepared.sourcePath, prepared.hash)
+    }
+    // Archive members are reported by their path in the archive
+    if prepared.originalPath != "" {
+        result.OriginalPath = prepared.originalPath
+    }
+    if err := journalResult(db, prepared, result); err != nil {
+        logger.Printf("Error updating import journal for %s: %v\n", prepared.sourcePath, err)
+    }
+    return result
+}
+
+
+// journalResult records the final journal state of files that did not go
+// through the import steps journaled by placeMedia.
+func journalResult(db *sql.DB, prepared preparedMedia, result ImportResult) error {
+    switch result.Status {
+    case "skipped_in_db", "skipped_small", "skipped_pair", "non_media":
+        return currentSession.mark(db, prepared.file, prepared.hash, journalSkipped, "")
+    case "error":
+        if prepared.hash != 0 && result.NewPath == "" {
+            return currentSession.mark(db, prepared.file, prepared.hash, journalHashed, "")
+        }
+    }
+    return nil
+}
+
+
+func placeMedia(prepared preparedMedia, destDir string, db *sql.DB) ImportResult {
+    if prepared.result != nil {
+        return *prepared.result
+    }
+    sourcePath := prepared.sourcePath
+    hash := prepared.hash
+    metadata := prepared.metadata
+
+    // Another worker may have committed an identical file since the
+    // duplicate check in prepareMedia
+    if result, isDuplicate := duplicateResult(db, sourcePath, hash); isDuplicate {
+        return result
+    }
+
+    partner, paired, err := findPairPartner(db, sourcePath, metadata)
+    if err != nil {
+        return ImportResult{Status: "error", Message: fmt.Sprintf("Error looking up RAW+JPEG pair: %v", err), OriginalPath: sourcePath}
+    }
+    var motionPartner pairPartner
+    live := false
+    if !paired {
+        motionPartner, live, err = findMotionPartner(db, sourcePath, metadata)
+        if err != nil {
+            return ImportResult{Status: "error", Message: fmt.Sprintf("Error looking up Live Photo: %v", err), OriginalPath: sourcePath}
+        }
+    }
+    layoutMetadata := metadata
+    if metadata.FileType == "image" && (paired || prepared.rawSibling != "") {
+        rawPath := prepared.rawSibling
+        if paired {
+            rawPath = partner.newPath
+        }
+        switch pairMode {
+        case pairsSkipJPEG:
+            // Only once the RAW file is in the library, the writer holds the
+            // JPEG back until then
+            if paired {
+                return ImportResult{Status: "skipped_pair", Message: fmt.Sprintf("RAW file of the same shot: %s", rawPath), OriginalPath: sourcePath}
+            }
+        case pairsSideBySide:
+            layoutMetadata.FileType = "image_raw"
+        }
+    }
+    // The video of a Live Photo goes next to its still
+    if metadata.FileType == "video" && (live || prepared.still != "") {
+        layoutMetadata.FileType = "image"
+    }
 
-    newPath := generateNewPath(sourcePath, metadata.DateTime, destDir, fileType)
+    newPath := generateNewPath(sourcePath, layoutMetadata, hash, destDir)
     
-    if _, err := os.Stat(newPath); err == nil {
+    if prepared.inPlace {
+        newPath = sourcePath
+    } else if plannedPaths[newPath] {
+        // Taken by another file in this dry run, which must have a different hash
+        newPath = generateUniqueFilename(newPath)
+    } else if _, err := os.Stat(newPath); err == nil {
         existingHash, err := computeXXHash(newPath)
         if err != nil {
             return ImportResult{Status: "error", Message: fmt.Sprintf("Error computing hash of existing file: %v", err), OriginalPath: sourcePath}
@@ -363,18 +629,193 @@ func processAndMoveMedia(sourcePath, destDir string, db *sql.DB) ImportResult {
         }
     }
 
-    if err := storeInDB(db, hash, sourcePath, newPath, metadata); err != nil {
-        return ImportResult{Status: "error", Message: fmt.Sprintf("Error storing in database: %v", err), OriginalPath: sourcePath, NewPath: newPath}
+    // The row goes in as pending together with the journal entry saying the
+    // file is on its way, so an interrupted copy can always be found again.
+    // It only becomes a regular entry once the file is in place.
+    status := mediaPending
+    var sidecars []placedSidecar
+    if sourcePath == newPath {
+        status = mediaOK
+        sidecars = placeSidecars(prepared.sidecars, sourcePath, newPath)
+    }
+    tx, err := db.Begin()
+    if err != nil {
+        return ImportResult{Status: "error", Message: fmt.Sprintf("Error storing in database: %v", err), OriginalPath: sourcePath}
+    }
+    originalPath := sourcePath
+    if prepared.originalPath != "" {
+        originalPath = prepared.originalPath
+    }
+    err = storeInDB(tx, hash, originalPath, newPath, metadata, status)
+    if err == nil && paired {
+        err = linkPair(tx, hash, partner)
+    }
+    if err == nil && live {
+        err = linkMotion(tx, hash, motionPartner)
+    }
+    if err == nil && prepared.motion.length > 0 && !extractMotion {
+        err = setMotionRole(tx, hash, motionEmbedded)
+    }
+    if err == nil {
+        err = storeSidecars(tx, hash, sidecars)
+    }
+    if err == nil {
+        err = storeTags(tx, hash, metadata.Tags)
+    }
+    if err == nil {
+        err = currentSession.mark(tx, prepared.file, hash, journalRecorded, newPath)
+    }
+    if err == nil {
+        err = tx.Commit()
+    } else {
+        tx.Rollback()
+    }
+    if err != nil {
+        return ImportResult{Status: "error", Message: fmt.Sprintf("Error storing in database: %v", err), OriginalPath: sourcePath}
     }
     if sourcePath == newPath {
-        return ImportResult{Status: "imported_existing", Message: "Existing file added to DB", OriginalPath: sourcePath, NewPath: newPath}
+        if err := currentSession.mark(db, prepared.file, hash, journalVerified, newPath); err != nil {
+            logger.Printf("Error updating import journal for %s: %v\n", sourcePath, err)
+        }
+        return ImportResult{Status: "imported_existing", Message: "Existing file added to DB", OriginalPath: sourcePath, NewPath: newPath, Sidecars: sidecarPaths(sidecars)}
+    }
+    if dryRun {
+        plannedPaths[newPath] = true
+        var planned []string
+        for _, sidecar := range prepared.sidecars {
+            planned = append(planned, sidecarTarget(sidecar, sourcePath, newPath))
+        }
+        return ImportResult{Status: "imported", Message: "File would be imported", OriginalPath: sourcePath, NewPath: newPath, Sidecars: planned}
     }
 
-    if err := copyFile(sourcePath, newPath); err != nil {
+    var renamed bool
+    if prepared.staged {
+        renamed, err = placeStagedFile(sourcePath, newPath)
+    } else {
+        renamed, err = copyFile(sourcePath, newPath)
+    }
+    if err != nil {
+        abandonMedia(db, prepared, newPath, false)
         return ImportResult{Status: "error", Message: fmt.Sprintf("Error copying file: %v", err), OriginalPath: sourcePath}
     }
+    if err := currentSession.mark(db, prepared.file, hash, journalCopied, newPath); err != nil {
+        logger.Printf("Error updating import journal for %s: %v\n", sourcePath, err)
+    }
+
+    info, err := os.Stat(newPath)
+    if err == nil && prepared.file.size != 0 && info.Size() != prepared.file.size {
+        err = fmt.Errorf("copied file has size %d, expected %d", info.Size(), prepared.file.size)
+    }
+    if err == nil && verifyCopies {
+        err = verifyCopy(newPath, hash)
+    }
+    if err != nil {
+        if renamed {
+            // Put the file back where it came from rather than deleting it
+            if restoreErr := os.Rename(newPath, sourcePath); restoreErr != nil {
+                logger.Printf("Error restoring %s to %s: %v\n", newPath, sourcePath, restoreErr)
+            }
+        }
+        abandonMedia(db, prepared, newPath, !renamed)
+        return ImportResult{Status: "error", Message: fmt.Sprintf("Error checking copied file: %v", err), OriginalPath: sourcePath}
+    }
+
+    sidecars = placeSidecars(prepared.sidecars, sourcePath, newPath)
+    tx, err = db.Begin()
+    if err == nil {
+        err = finalizeMedia(tx, hash, verifyCopies)
+        if err == nil {
+            err = storeSidecars(tx, hash, sidecars)
+        }
+        if err == nil {
+            err = currentSession.mark(tx, prepared.file, hash, journalVerified, newPath)
+        }
+        if err == nil {
+            err = tx.Commit()
+        } else {
+            tx.Rollback()
+        }
+    }
+    if err != nil {
+        // The file is in place, the next import repairs the pending row
+        return ImportResult{Status: "error", Message: fmt.Sprintf("Error finalizing database entry: %v", err), OriginalPath: sourcePath, NewPath: newPath}
+    }
+
+    // When moving, the source is only removed once the library is consistent
+    if moveFiles && !renamed {
+        if err := os.Remove(sourcePath); err != nil {
+            logger.Printf("Warning: imported %s but could not remove the source: %v\n", sourcePath, err)
+            fmt.Printf("\nWarning: imported %s but could not remove the source: %v\n", sourcePath, err)
+        }
+    }
+    if moveFiles {
+        for _, sidecar := range sidecars {
+            if sidecar.renamed || sidecar.source == sidecar.path {
+                continue
+            }
+            if err := os.Remove(sidecar.source); err != nil {
+                logger.Printf("Warning: imported %s but could not remove the source: %v\n", sidecar.source, err)
+            }
+        }
+    }
+
+    return ImportResult{Status: "imported", Message: "File successfully imported", OriginalPath: sourcePath, NewPath: newPath, Sidecars: sidecarPaths(sidecars)}
+}
 
-    return ImportResult{Status: "imported", Message: "File successfully imported", OriginalPath: sourcePath, NewPath: newPath}
+
+// verifyCopy re-reads a copied file and compares it with the hash of the source.
+func verifyCopy(path string, hash uint64) error {
+    copiedHash, err := computeXXHash(path)
+    if err != nil {
+        return fmt.Errorf("could not re-read copy: %w", err)
+    }
+    if copiedHash != hash {
+        return fmt.Errorf("hash mismatch after copy: expected %x, got %x", hash, copiedHash)
+    }
+    return nil
+}
+
+
+// abandonMedia undoes the pending row of a file whose copy failed, so that a
+// later import does not take it for a duplicate.
+func abandonMedia(db *sql.DB, prepared preparedMedia, newPath string, removeCopy bool) {
+    if removeCopy {
+        os.Remove(newPath)
+    }
+    tx, err := db.Begin()
+    if err != nil {
+        logger.Printf("Error removing pending entry for %s: %v\n", prepared.sourcePath, err)
+        return
+    }
+    _, err = tx.Exec(`DELETE FROM media WHERE hash = ? AND status = ?`, int64(prepared.hash), mediaPending)
+    if err == nil {
+        err = currentSession.mark(tx, prepared.file, prepared.hash, journalHashed, "")
+    }
+    if err == nil {
+        err = tx.Commit()
+    } else {
+        tx.Rollback()
+    }
+    if err != nil {
+        logger.Printf("Error removing pending entry for %s: %v\n", prepared.sourcePath, err)
+    }
+}
+
+
+func duplicateResult(db *sql.DB, sourcePath string, hash uint64) (ImportResult, bool) {
+    isDuplicate, existingPath, err := checkDuplicate(db, hash)
+    if err != nil {
+        return ImportResult{Status: "error", Message: fmt.Sprintf("Error checking for duplicates: %v", err), OriginalPath: sourcePath}, true
+    }
+    if !isDuplicate {
+        return ImportResult{}, false
+    }
+    return ImportResult{
+        Status:       "skipped_in_db",
+        Message:      fmt.Sprintf("Duplicate media found in database. Hash: %x, Existing file: %s", hash, existingPath),
+        OriginalPath: sourcePath,
+        InDatabase:   true,
+    }, true
 }
 
 
@@ -395,7 +836,7 @@ func generateUniqueFilename(path string) string {
     counter := 1
     newPath := path
     for {
-        if _, err := os.Stat(newPath); os.IsNotExist(err) {
+        if _, err := os.Stat(newPath); os.IsNotExist(err) && !plannedPaths[newPath] {
             // File doesn't exist, we can use this name
             return newPath
         }
@@ -405,11 +846,64 @@ func generateUniqueFilename(path string) string {
     }
 }
 func initDB(destDir string) (*sql.DB, error) {
+    return openDB(filepath.Join(destDir, "media.db"))
+}
+
+
+// openDryRunDB returns a throwaway copy of the library database, so a dry
+// run can go through the same inserts as a real import. The caller removes
+// the returned file when done.
+func openDryRunDB(destDir string) (*sql.DB, string, error) {
+    tempFile, err := os.CreateTemp("", "picmover-dry-run-*.db")
+    if err != nil {
+        return nil, "", fmt.Errorf("error creating temporary database: %w", err)
+    }
+    tempPath := tempFile.Name()
+    tempFile.Close()
+    os.Remove(tempPath)
+
     dbPath := filepath.Join(destDir, "media.db")
+    if _, err := os.Stat(dbPath); err == nil {
+        // Opened read-write so SQLite removes its WAL files again on close,
+        // the database itself is only read
+        source, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=rw")
+        if err != nil {
+            return nil, "", fmt.Errorf("error opening database: %w", err)
+        }
+        _, err = source.Exec("VACUUM INTO ?", tempPath)
+        source.Close()
+        if err != nil {
+            os.Remove(tempPath)
+            return nil, "", fmt.Errorf("error copying database: %w", err)
+        }
+    }
+
+    db, err := openDB(tempPath)
+    if err != nil {
+        os.Remove(tempPath)
+        return nil, "", err
+    }
+    return db, tempPath, nil
+}
+
+
+// openDBSchema opens a database and adds the tables, columns and indexes it
+// is missing. Unlike openDB it leaves the existing rows as they are.
+func openDBSchema(dbPath string) (*sql.DB, error) {
     db, err := sql.Open("sqlite3", dbPath)
     if err != nil {
         return nil, fmt.Errorf("error opening database: %w", err)
     }
+    // A single connection serializes access from the import workers and the
+    // writer, so SQLite never reports the database as locked.
+    db.SetMaxOpenConns(1)
+
+    // The import journal adds a few small writes per file, WAL keeps those cheap
+    _, err = db.Exec(`PRAGMA journal_mode = WAL; PRAGMA synchronous = NORMAL`)
+    if err != nil {
+        db.Close()
+        return nil, fmt.Errorf("error configuring database: %w", err)
+    }
 
     _, err = db.Exec(`
     CREATE TABLE IF NOT EXISTS media (
@@ -429,22 +923,431 @@ func initDB(destDir string) (*sql.DB, error) {
         db.Close()
         return nil, fmt.Errorf("error creating table: %w", err)
     }
+    for _, column := range mediaColumns {
+        if err = ensureColumn(db, "media", column.name, column.definition); err != nil {
+            break
+        }
+    }
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+
+    _, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS import_sessions (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        source_dir TEXT,
+        started_at DATETIME,
+        finished_at DATETIME,
+        status TEXT
+    )`)
+    if err != nil {
+        db.Close()
+        return nil, fmt.Errorf("error creating table: %w", err)
+    }
+
+    _, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS import_journal (
+        session_id INTEGER REFERENCES import_sessions(id),
+        source_path TEXT,
+        size INTEGER,
+        mod_time INTEGER,
+        hash INTEGER,
+        state TEXT,
+        new_path TEXT,
+        PRIMARY KEY (session_id, source_path)
+    )`)
+    if err == nil {
+        err = ensureColumn(db, "import_sessions", "heartbeat", "INTEGER")
+    }
+    if err != nil {
+        db.Close()
+        return nil, fmt.Errorf("error creating table: %w", err)
+    }
+
+    // Capture time corrections, with what is needed to undo them
+    _, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS timeshifts (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        created_at DATETIME,
+        offset_seconds INTEGER,
+        selection TEXT,
+        undone_at DATETIME
+    )`)
+    if err == nil {
+        _, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS timeshift_log (
+            shift_id INTEGER REFERENCES timeshifts(id),
+            media_id INTEGER,
+            old_date DATETIME,
+            new_date DATETIME,
+            old_path TEXT,
+            new_path TEXT,
+            old_hash INTEGER,
+            new_hash INTEGER,
+            exif_written INTEGER,
+            xmp_written INTEGER
+        )`)
+    }
+    if err != nil {
+        db.Close()
+        return nil, fmt.Errorf("error creating table: %w", err)
+    }
+
+    // Files such as XMP or THM that belong to a media file
+    _, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS sidecars (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        media_id INTEGER REFERENCES media(id),
+        kind TEXT,
+        original_path TEXT,
+        path TEXT,
+        hash INTEGER
+    )`)
+    if err != nil {
+        db.Close()
+        return nil, fmt.Errorf("error creating table: %w", err)
+    }
+
+    _, err = db.Exec(`
+    CREATE TABLE IF NOT EXISTS tags (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        media_id INTEGER REFERENCES media(id),
+        kind TEXT,
+        value TEXT
+    )`)
+    if err != nil {
+        db.Close()
+        return nil, fmt.Errorf("error creating table: %w", err)
+    }
+    _, err = db.Exec(`CREATE INDEX IF NOT EXISTS import_journal_state ON import_journal (state)`)
+    if err == nil {
+        _, err = db.Exec(`CREATE INDEX IF NOT EXISTS media_position ON media (latitude, longitude)`)
+    }
+    if err == nil {
+        _, err = db.Exec(`CREATE INDEX IF NOT EXISTS timeshift_log_old_hash ON timeshift_log (old_hash)`)
+    }
+    if err == nil {
+        _, err = db.Exec(`CREATE INDEX IF NOT EXISTS media_date_taken ON media (date_taken)`)
+    }
+    if err == nil {
+        _, err = db.Exec(`CREATE INDEX IF NOT EXISTS media_shot_id ON media (shot_id)`)
+    }
+    if err == nil {
+        _, err = db.Exec(`CREATE INDEX IF NOT EXISTS sidecars_media_id ON sidecars (media_id)`)
+    }
+    if err == nil {
+        _, err = db.Exec(`CREATE INDEX IF NOT EXISTS media_content_id ON media (content_id)`)
+    }
+    if err == nil {
+        _, err = db.Exec(`CREATE INDEX IF NOT EXISTS tags_media_id ON tags (media_id)`)
+    }
+    if err == nil {
+        _, err = db.Exec(`CREATE INDEX IF NOT EXISTS tags_value ON tags (kind, value)`)
+    }
+    if err != nil {
+        db.Close()
+        return nil, fmt.Errorf("error creating index: %w", err)
+    }
+    return db, nil
+}
+
+func openDB(dbPath string) (*sql.DB, error) {
+    db, err := openDBSchema(dbPath)
+    if err != nil {
+        return nil, err
+    }
+
+    // Migrations that rewrite rows run once, when a database of an older
+    // schema version is opened
+    var version int
+    err = db.QueryRow(`PRAGMA user_version`).Scan(&version)
+    if err == nil && version < 1 {
+        err = migrateLocations(db)
+    }
+    if err == nil && version < schemaVersion {
+        _, err = db.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, schemaVersion))
+    }
+    if err != nil {
+        db.Close()
+        return nil, fmt.Errorf("error migrating database: %w", err)
+    }
 
     return db, nil
 }
 
 
-func storeInDB(db *sql.DB, hash uint64, originalPath, newPath string, metadata MediaMetadata) error {
-    _, err := db.Exec(`
-        INSERT INTO media (hash, original_path, new_path, date_taken, file_type, location, camera_model, camera_make, camera_type, resolution) 
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-        int64(hash), originalPath, newPath, metadata.DateTime, metadata.FileType, metadata.Location, metadata.CameraModel, metadata.CameraMake, metadata.CameraType, metadata.Resolution)
+// schemaVersion is stored as the user_version of media.db.
+//  1: locations migrated to latitude, longitude and altitude
+const schemaVersion = 1
+
+// dbExecer is implemented by both *sql.DB and *sql.Tx.
+type dbExecer interface {
+    Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Values of media.status. Rows are pending while their file is being
+// copied into the library, and missing once reconcile has found their file
+// gone.
+const (
+    mediaPending = "pending"
+    mediaOK      = "ok"
+    mediaMissing = "missing"
+)
+
+// mediaColumns are the columns added to the media table after its first
+// version, in the order they were introduced.
+var mediaColumns = []struct {
+    name       string
+    definition string
+}{
+    {"status", "TEXT NOT NULL DEFAULT 'ok'"},
+    {"last_verified", "DATETIME"},
+    {"verify_status", "TEXT"},
+    {"duration", "REAL"},
+    {"lens_model", "TEXT"},
+    {"focal_length", "REAL"},
+    {"aperture", "REAL"},
+    {"exposure_time", "REAL"},
+    {"iso", "INTEGER"},
+    {"flash", "TEXT"},
+    {"orientation", "INTEGER"},
+    {"exposure_program", "TEXT"},
+    {"serial_number", "TEXT"},
+    {"latitude", "REAL"},
+    {"longitude", "REAL"},
+    {"altitude", "REAL"},
+    {"country", "TEXT"},
+    {"region", "TEXT"},
+    {"city", "TEXT"},
+    {"tz_offset", "INTEGER"},
+    {"date_source", "TEXT"},
+    {"shot_id", "INTEGER"},
+    {"content_id", "TEXT"},
+    {"motion_role", "TEXT"},
+}
+
+// ensureColumn adds a column to a table created by an older version.
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+    rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+    if err != nil {
+        return fmt.Errorf("error reading schema of %s: %w", table, err)
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var cid, notNull, pk int
+        var name, colType string
+        var defaultValue sql.NullString
+        if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+            return fmt.Errorf("error reading schema of %s: %w", table, err)
+        }
+        if name == column {
+            return nil
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return fmt.Errorf("error reading schema of %s: %w", table, err)
+    }
+    rows.Close()
+
+    _, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+    if err != nil {
+        return fmt.Errorf("error adding column %s to %s: %w", column, table, err)
+    }
+    return nil
+}
+
+
+func storeInDB(db dbExecer, hash uint64, originalPath, newPath string, metadata MediaMetadata, status string) error {
+    // A file that went missing from the library is replaced by its new copy
+    _, err := db.Exec(`DELETE FROM media WHERE hash = ? AND status = ?`, int64(hash), mediaMissing)
+    if err != nil {
+        return err
+    }
+    _, err = db.Exec(`
+        INSERT INTO media (hash, original_path, new_path, date_taken, file_type, location, latitude, longitude, altitude, camera_model, camera_make, camera_type, resolution, duration,
+            lens_model, focal_length, aperture, exposure_time, iso, flash, orientation, exposure_program, serial_number, country, region, city, tz_offset, date_source, content_id, status) 
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+        int64(hash), originalPath, newPath, metadata.DateTime, metadata.FileType, metadata.Location, metadata.Latitude, metadata.Longitude, metadata.Altitude, metadata.CameraModel, metadata.CameraMake, metadata.CameraType, metadata.Resolution, nullIfZero(metadata.Duration),
+        nullIfZero(metadata.LensModel), nullIfZero(metadata.FocalLength), nullIfZero(metadata.Aperture), nullIfZero(metadata.ExposureTime), nullIfZero(metadata.ISO),
+        nullIfZero(metadata.Flash), nullIfZero(metadata.Orientation), nullIfZero(metadata.ExposureProgram), nullIfZero(metadata.SerialNumber),
+        nullIfZero(metadata.Country), nullIfZero(metadata.Region), nullIfZero(metadata.City), metadata.TZOffset, nullIfZero(metadata.DateSource), nullIfZero(metadata.ContentID), status)
+    return err
+}
+
+// migrateLocations fills latitude, longitude and altitude of rows written
+// before those columns existed, and rewrites their location in the
+// "lat,long" form. Videos used to store the raw ISO 6709 string. Locations
+// that can not be parsed are logged and left as they are.
+func migrateLocations(db *sql.DB) error {
+    rows, err := db.Query(`SELECT id, location FROM media WHERE latitude IS NULL AND location IS NOT NULL AND location != ''`)
+    if err != nil {
+        return err
+    }
+    type locationRow struct {
+        id       int64
+        location string
+    }
+    var pending []locationRow
+    for rows.Next() {
+        var row locationRow
+        if err := rows.Scan(&row.id, &row.location); err != nil {
+            rows.Close()
+            return err
+        }
+        pending = append(pending, row)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil || len(pending) == 0 {
+        return err
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    for _, row := range pending {
+        lat, long, altitude, err := parseLocation(row.location)
+        if err != nil {
+            logger.Printf("Warning: Could not migrate location %q of entry %d: %v\n", row.location, row.id, err)
+            continue
+        }
+        _, err = tx.Exec(`UPDATE media SET location = ?, latitude = ?, longitude = ?, altitude = ? WHERE id = ?`,
+            formatLocation(lat, long), lat, long, altitude, row.id)
+        if err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+// nullIfZero stores unknown values, which are zero in MediaMetadata, as NULL.
+func nullIfZero(v interface{}) interface{} {
+    switch v {
+    case "", 0, 0.0:
+        return nil
+    }
+    return v
+}
+
+// finalizeMedia marks the row of a file that is in place as regular.
+// verified records that its content was just checked against the hash.
+func finalizeMedia(db dbExecer, hash uint64, verified bool) error {
+    if verified {
+        _, err := db.Exec(`UPDATE media SET status = ?, last_verified = ?, verify_status = ? WHERE hash = ?`,
+            mediaOK, time.Now().UTC(), verifyOK, int64(hash))
+        return err
+    }
+    _, err := db.Exec(`UPDATE media SET status = ? WHERE hash = ?`, mediaOK, int64(hash))
     return err
 }
 
+// repairPendingMedia resolves rows left pending by an interrupted import.
+// If the file made it to new_path intact the row is finalized, otherwise
+// the row is removed so the file can be imported again. Journal entries of
+// the affected files are updated to match, and temporary files the import
+// left next to them are deleted. Rows of imports that are still running are
+// left alone.
+func repairPendingMedia(db *sql.DB) (finalized, removed int, err error) {
+    live, err := liveSessions(db)
+    if err != nil {
+        return 0, 0, err
+    }
+    rows, err := db.Query(`SELECT m.hash, m.new_path, j.session_id FROM media m
+        LEFT JOIN import_journal j ON j.hash = m.hash AND j.new_path = m.new_path AND j.state IN (?, ?)
+        WHERE m.status = ?`, journalRecorded, journalCopied, mediaPending)
+    if err != nil {
+        return 0, 0, err
+    }
+    type pendingRow struct {
+        hash    uint64
+        newPath string
+    }
+    var pending []pendingRow
+    // A row can have journal entries in more than one session
+    seen := map[uint64]bool{}
+    running := map[uint64]bool{}
+    for rows.Next() {
+        var p pendingRow
+        var hash int64
+        var session sql.NullInt64
+        if err := rows.Scan(&hash, &p.newPath, &session); err != nil {
+            rows.Close()
+            return 0, 0, err
+        }
+        p.hash = uint64(hash)
+        if session.Valid && live[session.Int64] {
+            running[p.hash] = true
+        }
+        if !seen[p.hash] {
+            seen[p.hash] = true
+            pending = append(pending, p)
+        }
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, 0, err
+    }
+
+    dirs := map[string]bool{}
+    defer func() {
+        for dir := range dirs {
+            removeStaleTempFiles(dir, live)
+        }
+    }()
+    for _, p := range pending {
+        if running[p.hash] {
+            continue
+        }
+        dirs[filepath.Dir(p.newPath)] = true
+        existingHash, hashErr := computeXXHash(p.newPath)
+        complete := hashErr == nil && existingHash == p.hash
+
+        tx, err := db.Begin()
+        if err != nil {
+            return finalized, removed, err
+        }
+        if complete {
+            err = finalizeMedia(tx, p.hash, true)
+            if err == nil {
+                _, err = tx.Exec(`UPDATE import_journal SET state = ? WHERE hash = ? AND new_path = ? AND state IN (?, ?)`,
+                    journalVerified, int64(p.hash), p.newPath, journalRecorded, journalCopied)
+            }
+        } else {
+            _, err = tx.Exec(`DELETE FROM media WHERE hash = ? AND status = ?`, int64(p.hash), mediaPending)
+            if err == nil {
+                _, err = tx.Exec(`UPDATE import_journal SET state = ?, new_path = NULL WHERE hash = ? AND new_path = ? AND state IN (?, ?)`,
+                    journalHashed, int64(p.hash), p.newPath, journalRecorded, journalCopied)
+            }
+        }
+        if err != nil {
+            tx.Rollback()
+            return finalized, removed, err
+        }
+        if err := tx.Commit(); err != nil {
+            return finalized, removed, err
+        }
+
+        if complete {
+            logger.Printf("Repaired: %s was complete\n", p.newPath)
+            finalized++
+        } else {
+            logger.Printf("Repaired: removed unfinished entry for %s\n", p.newPath)
+            removed++
+        }
+    }
+    return finalized, removed, nil
+}
+
 func checkDuplicate(db *sql.DB, hash uint64) (bool, string, error) {
     var existingPath string
-    err := db.QueryRow("SELECT new_path FROM media WHERE hash = ?", int64(hash)).Scan(&existingPath)
+    // Files whose EXIF dates were rewritten by timeshift are still known by
+    // their original hash
+    err := db.QueryRow(`SELECT new_path FROM media WHERE status != ? AND (hash = ? OR id IN (
+        SELECT l.media_id FROM timeshift_log l JOIN timeshifts t ON t.id = l.shift_id
+        WHERE l.old_hash = ? AND l.exif_written AND t.undone_at IS NULL))`,
+        mediaMissing, int64(hash), int64(hash)).Scan(&existingPath)
     if err == sql.ErrNoRows {
         return false, "", nil
     }
@@ -456,91 +1359,125 @@ func checkDuplicate(db *sql.DB, hash uint64) (bool, string, error) {
 
 
 
-func generateNewPath(sourcePath string, dateTime time.Time, destDir string, fileType string) string {
-    fileName := filepath.Base(sourcePath)
-    return filepath.Join(destDir, fileType, dateTime.Format("2006"), dateTime.Format("01"), fileName)
+func generateNewPath(sourcePath string, metadata MediaMetadata, hash uint64, destDir string) string {
+    layout := destLayout
+    if layout == nil {
+        layout, _ = parseLayout(defaultLayout)
+    }
+    return filepath.Join(destDir, layout.expand(layoutFile{sourcePath: sourcePath, metadata: metadata, hash: hash}))
 }
 
 
-func copyFile(src, dst string) error {
+// copyFile places src at dst. With --move the file is renamed if possible,
+// in which case renamed is true. Otherwise the data goes to a temporary file
+// next to dst that is synced and then renamed into place, so dst never holds
+// a partial copy. The source is never removed here.
+func copyFile(src, dst string) (renamed bool, err error) {
     if src == dst {
         //it already is in the correct place, nothing to be done
-        return nil
+        return false, nil
     }
 
     // Ensure the destination directory exists
-    err := os.MkdirAll(filepath.Dir(dst), os.ModePerm)
+    err = os.MkdirAll(filepath.Dir(dst), os.ModePerm)
     if err != nil {
-       return err    
+       return false, err    
     } 
     
     if moveFiles {
         // Attempt to move the file
         err := os.Rename(src, dst)
         if err == nil {
-            return nil // Successfully moved
+            return true, nil // Successfully moved
         }
         // Check if the error is due to cross-device link
         if linkErr, ok := err.(*os.LinkError); ok && linkErr.Err == syscall.EXDEV {
             // Fall through to copy-and-delete for cross-device moves
             logger.Printf("Can't move file from %s to %s (cross-device link). Falling back to copy-and-delete.", src, dst)
         }  else {
-            return fmt.Errorf("failed to move file from %s to %s: %w", src, dst, err)
+            return false, fmt.Errorf("failed to move file from %s to %s: %w", src, dst, err)
         }
     }
 
 
     sourceFile, err := os.Open(src)
     if err != nil {
-        return err
+        return false, err
     }
     defer sourceFile.Close()
 
     // Get file information
     sourceInfo, err := sourceFile.Stat()
     if err != nil {
-        return err
+        return false, err
     }
 
   
-    // Create the destination file
-    destFile, err := os.Create(dst)
+    // Create the temporary file in the destination directory, so the final
+    // rename stays on one file system
+    destFile, err := os.CreateTemp(filepath.Dir(dst), tempFilePattern())
     if err != nil {
-        return err
+        return false, err
     }
-    defer destFile.Close()
+    tempPath := destFile.Name()
+    defer func() {
+        if err != nil {
+            destFile.Close()
+            os.Remove(tempPath)
+        }
+    }()
 
     // Copy the contents
     _, err = io.Copy(destFile, sourceFile)
     if err != nil {
-        return err
+        return false, err
     }
 
     // Sync to ensure write is complete
     err = destFile.Sync()
     if err != nil {
-        return err
+        return false, err
     }
 
     // Close the destination file before setting times
-    destFile.Close()
+    err = destFile.Close()
+    if err != nil {
+        return false, err
+    }
 
-    // Preserve modification time
-    err = os.Chtimes(dst, sourceInfo.ModTime(), sourceInfo.ModTime())
+    // CreateTemp makes the file private to its owner, give it the
+    // permissions of the source instead
+    err = os.Chmod(tempPath, sourceInfo.Mode().Perm())
     if err != nil {
-        return err
+        return false, err
     }
 
-    // If we're moving, delete the source file after successful copy
-    if moveFiles {
-        err = os.Remove(src)
-        if err != nil {
-            // If we can't remove the source, we should try to remove the destination to avoid duplication
-            os.Remove(dst)
-            return fmt.Errorf("failed to remove source file after copy: %w", err)
-        }
+    // Preserve modification time
+    err = os.Chtimes(tempPath, sourceInfo.ModTime(), sourceInfo.ModTime())
+    if err != nil {
+        return false, err
     }
 
-    return nil
+    err = os.Rename(tempPath, dst)
+    if err != nil {
+        return false, err
+    }
+    syncDir(filepath.Dir(dst))
+    return false, nil
 }
 
+
+// tempFilePrefix marks files picmover is still writing. Leftovers from an
+// interrupted import are deleted when its pending rows are repaired.
+const tempFilePrefix = ".picmover-"
+
+// syncDir makes a rename in dir durable. Not all platforms support syncing
+// directories, so errors are ignored.
+func syncDir(dir string) {
+    d, err := os.Open(dir)
+    if err != nil {
+        return
+    }
+    d.Sync()
+    d.Close()
+}
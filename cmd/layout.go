@@ -0,0 +1,130 @@
+package cmd
+
+import (
+    "fmt"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// defaultLayout reproduces the original <type>/<YYYY>/<MM>/<name> structure.
+const defaultLayout = "{file_type}/{year}/{month}/{basename}"
+
+var layoutTokenPattern = regexp.MustCompile(`\{([a-z0-9_]+)\}`)
+
+// layoutFields maps the tokens usable in a layout template to their values.
+var layoutFields = map[string]func(f layoutFile) string{
+    "year":         func(f layoutFile) string { return f.metadata.DateTime.Format("2006") },
+    "month":        func(f layoutFile) string { return f.metadata.DateTime.Format("01") },
+    "day":          func(f layoutFile) string { return f.metadata.DateTime.Format("02") },
+    "hour":         func(f layoutFile) string { return f.metadata.DateTime.Format("15") },
+    "minute":       func(f layoutFile) string { return f.metadata.DateTime.Format("04") },
+    "second":       func(f layoutFile) string { return f.metadata.DateTime.Format("05") },
+    "date":         func(f layoutFile) string { return f.metadata.DateTime.Format("2006-01-02") },
+    "time":         func(f layoutFile) string { return f.metadata.DateTime.Format("150405") },
+    "camera_make":  func(f layoutFile) string { return f.metadata.CameraMake },
+    "camera_model": func(f layoutFile) string { return f.metadata.CameraModel },
+    "camera_type":  func(f layoutFile) string { return f.metadata.CameraType },
+    "file_type":    func(f layoutFile) string { return f.metadata.FileType },
+    "resolution":   func(f layoutFile) string { return f.metadata.Resolution },
+    "country":      func(f layoutFile) string { return f.metadata.Country },
+    "region":       func(f layoutFile) string { return f.metadata.Region },
+    "city":         func(f layoutFile) string { return f.metadata.City },
+    "basename":     func(f layoutFile) string { return filepath.Base(f.sourcePath) },
+    "name": func(f layoutFile) string {
+        base := filepath.Base(f.sourcePath)
+        return strings.TrimSuffix(base, filepath.Ext(base))
+    },
+    "ext": func(f layoutFile) string {
+        return strings.TrimPrefix(strings.ToLower(filepath.Ext(f.sourcePath)), ".")
+    },
+    "hash": func(f layoutFile) string { return fmt.Sprintf("%016x", f.hash) },
+}
+
+// layoutFile is everything a layout template can refer to.
+type layoutFile struct {
+    sourcePath string
+    metadata   MediaMetadata
+    hash       uint64
+}
+
+// pathLayout is a parsed destination template such as
+// "{year}/{year}-{month}-{day}/{camera_model}/{basename}".
+type pathLayout struct {
+    template string
+}
+
+func parseLayout(template string) (*pathLayout, error) {
+    if strings.TrimSpace(template) == "" {
+        return nil, fmt.Errorf("empty layout")
+    }
+    if filepath.IsAbs(template) || strings.HasPrefix(template, "/") {
+        return nil, fmt.Errorf("layout %q must be relative to the destination", template)
+    }
+    for _, segment := range strings.Split(template, "/") {
+        if segment == "" || segment == "." || segment == ".." {
+            return nil, fmt.Errorf("layout %q contains an invalid path element %q", template, segment)
+        }
+    }
+    for _, match := range layoutTokenPattern.FindAllStringSubmatch(template, -1) {
+        if _, ok := layoutField(match[1]); !ok {
+            return nil, fmt.Errorf("unknown layout field {%s}", match[1])
+        }
+    }
+    // Anything that looks like a token but was not matched is a typo
+    stripped := layoutTokenPattern.ReplaceAllString(template, "")
+    if strings.ContainsAny(stripped, "{}") {
+        return nil, fmt.Errorf("layout %q has unbalanced braces", template)
+    }
+    return &pathLayout{template: template}, nil
+}
+
+// layoutField resolves a token name, including the {hashN} prefixes.
+func layoutField(name string) (func(f layoutFile) string, bool) {
+    if field, ok := layoutFields[name]; ok {
+        return field, true
+    }
+    if strings.HasPrefix(name, "hash") {
+        n, err := strconv.Atoi(strings.TrimPrefix(name, "hash"))
+        if err == nil && n >= 1 && n <= 16 {
+            return func(f layoutFile) string { return fmt.Sprintf("%016x", f.hash)[:n] }, true
+        }
+    }
+    return nil, false
+}
+
+// expand returns the path of the file relative to the library root. Each
+// path element is expanded and sanitized separately, so a value can never
+// introduce extra directories.
+func (l *pathLayout) expand(f layoutFile) string {
+    segments := strings.Split(l.template, "/")
+    for i, segment := range segments {
+        expanded := layoutTokenPattern.ReplaceAllStringFunc(segment, func(token string) string {
+            field, _ := layoutField(token[1 : len(token)-1])
+            value := sanitizePathElement(field(f))
+            if value == "" {
+                return "unknown"
+            }
+            return value
+        })
+        segments[i] = sanitizePathElement(expanded)
+        if segments[i] == "" || segments[i] == "." || segments[i] == ".." {
+            segments[i] = "unknown"
+        }
+    }
+    return filepath.Join(segments...)
+}
+
+// sanitizePathElement replaces characters that are unsafe in file names on
+// any of the supported platforms.
+func sanitizePathElement(s string) string {
+    s = strings.Map(func(r rune) rune {
+        if r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"/\|?*`, r) {
+            return '_'
+        }
+        return r
+    }, s)
+    // Windows does not allow trailing dots or spaces
+    return strings.Trim(s, " .")
+}
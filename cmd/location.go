@@ -0,0 +1,95 @@
+package cmd
+
+import (
+    "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// iso6709Pattern splits an ISO 6709 string such as "+60.1699+024.9384+012.000/"
+// into latitude, longitude and optional altitude.
+var iso6709Pattern = regexp.MustCompile(`^([+-][0-9.]+)([+-][0-9.]+)([+-][0-9.]+)?(CRS[^/]*)?/?$`)
+
+// setLocation stores a position and its "lat,long" text form.
+func (m *MediaMetadata) setLocation(lat, long float64, altitude *float64) {
+    m.Latitude = &lat
+    m.Longitude = &long
+    m.Altitude = altitude
+    m.Location = formatLocation(lat, long)
+}
+
+func formatLocation(lat, long float64) string {
+    return fmt.Sprintf("%.6f,%.6f", lat, long)
+}
+
+// parseLocation reads a location as stored by earlier versions, either
+// "lat,long" or ISO 6709.
+func parseLocation(location string) (lat, long float64, altitude *float64, err error) {
+    if parts := strings.Split(location, ","); len(parts) == 2 {
+        lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+        long, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+        if err1 == nil && err2 == nil {
+            return lat, long, nil, nil
+        }
+    }
+    return parseISO6709(location)
+}
+
+// parseISO6709 parses the location format used in QuickTime and Android
+// videos. Degrees may be given as decimal degrees (±DD.D±DDD.D), degrees
+// and minutes (±DDMM.M±DDDMM.M) or degrees, minutes and seconds.
+func parseISO6709(s string) (lat, long float64, altitude *float64, err error) {
+    match := iso6709Pattern.FindStringSubmatch(strings.TrimSpace(s))
+    if match == nil {
+        return 0, 0, nil, fmt.Errorf("invalid ISO 6709 location %q", s)
+    }
+    lat, err = parseISO6709Angle(match[1], 2)
+    if err == nil {
+        long, err = parseISO6709Angle(match[2], 3)
+    }
+    if err != nil {
+        return 0, 0, nil, fmt.Errorf("invalid ISO 6709 location %q: %w", s, err)
+    }
+    if lat < -90 || lat > 90 || long < -180 || long > 180 {
+        return 0, 0, nil, fmt.Errorf("ISO 6709 location %q out of range", s)
+    }
+    if match[3] != "" {
+        if alt, err := strconv.ParseFloat(match[3], 64); err == nil {
+            altitude = &alt
+        }
+    }
+    return lat, long, altitude, nil
+}
+
+// parseISO6709Angle converts one signed component, where degreeDigits is
+// the number of digits used for whole degrees.
+func parseISO6709Angle(s string, degreeDigits int) (float64, error) {
+    sign := 1.0
+    if s[0] == '-' {
+        sign = -1
+    }
+    s = s[1:]
+    intPart := s
+    if i := strings.IndexByte(s, '.'); i >= 0 {
+        intPart = s[:i]
+    }
+    value, err := strconv.ParseFloat(s, 64)
+    if err != nil {
+        return 0, err
+    }
+    switch len(intPart) {
+    case degreeDigits:
+        // decimal degrees
+    case degreeDigits + 2:
+        degrees := float64(int(value / 100))
+        value = degrees + (value-degrees*100)/60
+    case degreeDigits + 4:
+        degrees := float64(int(value / 10000))
+        minutes := float64(int((value - degrees*10000) / 100))
+        value = degrees + minutes/60 + (value-degrees*10000-minutes*100)/3600
+    default:
+        return 0, fmt.Errorf("unexpected number of digits in %q", s)
+    }
+    return sign * value, nil
+}
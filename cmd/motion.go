@@ -0,0 +1,321 @@
+package cmd
+
+import (
+    "bytes"
+    "database/sql"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Live Photos and motion photos are stills with a few seconds of video.
+// iPhones write the video as a MOV file with the same name as the still,
+// both carrying the same ContentIdentifier. Google and Samsung phones append
+// an MP4 to the JPEG. The video is kept next to its still, and the two are
+// linked by a shared shot_id like RAW+JPEG pairs.
+
+// Values of media.motion_role
+const (
+    motionStill    = "still"        // still of a Live Photo or of an extracted motion photo
+    motionVideo    = "motion"       // its video
+    motionEmbedded = "motion_photo" // JPEG that still contains its video
+)
+
+var extractMotion bool
+
+// Without content identifiers a still and a video are only taken for a Live
+// Photo if the video is short and starts close to the still.
+const (
+    maxMotionDuration = 10.0 // seconds
+    maxMotionTimeDiff = 5 * time.Second
+)
+
+var (
+    // Google motion photos, older versions
+    microVideoOffsetPattern = regexp.MustCompile(`MicroVideoOffset="(\d+)"`)
+    // Google motion photos: a directory of the items appended to the JPEG
+    containerItemPattern     = regexp.MustCompile(`<\w+:Item\s[^>]*>`)
+    motionItemLengthPattern  = regexp.MustCompile(`\w+:Length="(\d+)"`)
+    motionItemSemanticMarker = regexp.MustCompile(`\w+:Semantic="MotionPhoto"`)
+)
+
+// Samsung phones end their files with a trailer listing the data they
+// appended after the JPEG, the video among it under samsungMotionMarker.
+// The trailer ends with the size of its directory and "SEFT", and the
+// directory starts with "SEFH".
+var samsungMotionMarker = []byte("MotionPhoto_Data")
+
+const (
+    // The XMP packet is near the start of the file
+    motionHeadSize = 256 * 1024
+    // Larger Samsung trailer directories are taken for corrupt
+    maxSamsungDirSize = 64 * 1024
+)
+
+// embeddedVideo is the location of the video in a motion photo.
+type embeddedVideo struct {
+    offset int64
+    length int64
+}
+
+// findEmbeddedVideo looks for the video appended to a JPEG motion photo.
+// Only the start of the file and the Samsung trailer at its end are read.
+func findEmbeddedVideo(path string) (embeddedVideo, bool) {
+    ext := strings.ToLower(filepath.Ext(path))
+    if ext != ".jpg" && ext != ".jpeg" {
+        return embeddedVideo{}, false
+    }
+    file, err := os.Open(path)
+    if err != nil {
+        logger.Printf("Warning: Could not look for a motion photo video in %s: %v\n", path, err)
+        return embeddedVideo{}, false
+    }
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil {
+        logger.Printf("Warning: Could not look for a motion photo video in %s: %v\n", path, err)
+        return embeddedVideo{}, false
+    }
+    size := info.Size()
+
+    head := make([]byte, motionHeadSize)
+    n, err := file.ReadAt(head, 0)
+    if err != nil && err != io.EOF {
+        logger.Printf("Warning: Could not look for a motion photo video in %s: %v\n", path, err)
+        return embeddedVideo{}, false
+    }
+    head = head[:n]
+    var candidates []int64
+    if match := microVideoOffsetPattern.FindSubmatch(head); match != nil {
+        if n, err := strconv.ParseInt(string(match[1]), 10, 64); err == nil {
+            candidates = append(candidates, size-n)
+        }
+    }
+    for _, item := range containerItemPattern.FindAll(head, -1) {
+        if !motionItemSemanticMarker.Match(item) {
+            continue
+        }
+        if match := motionItemLengthPattern.FindSubmatch(item); match != nil {
+            if n, err := strconv.ParseInt(string(match[1]), 10, 64); err == nil {
+                candidates = append(candidates, size-n)
+            }
+        }
+    }
+    if offset, ok := findSamsungVideo(file, size); ok {
+        candidates = append(candidates, offset)
+    }
+
+    // The video must start with the ftyp box of an MP4 file
+    boxType := make([]byte, 4)
+    for _, offset := range candidates {
+        if offset > 0 && offset+8 <= size {
+            if _, err := file.ReadAt(boxType, offset+4); err == nil && string(boxType) == "ftyp" {
+                return embeddedVideo{offset: offset, length: size - offset}, true
+            }
+        }
+    }
+    return embeddedVideo{}, false
+}
+
+// findSamsungVideo returns the offset of the video listed in the trailer of
+// a Samsung motion photo.
+func findSamsungVideo(r io.ReaderAt, size int64) (int64, bool) {
+    if size < 8 {
+        return 0, false
+    }
+    tail := make([]byte, 8)
+    if _, err := r.ReadAt(tail, size-8); err != nil || string(tail[4:]) != "SEFT" {
+        return 0, false
+    }
+    dirSize := int64(binary.LittleEndian.Uint32(tail[:4]))
+    dirStart := size - 8 - dirSize
+    if dirSize < 12 || dirSize > maxSamsungDirSize || dirStart < 0 {
+        return 0, false
+    }
+    dir := make([]byte, dirSize)
+    if _, err := r.ReadAt(dir, dirStart); err != nil || string(dir[:4]) != "SEFH" {
+        return 0, false
+    }
+    // Entries of 12 bytes: type, offset of the data counted back from the
+    // directory, and its length. The data starts with its name.
+    count := int(binary.LittleEndian.Uint32(dir[8:12]))
+    for i, pos := 0, 12; i < count && pos+12 <= len(dir); i, pos = i+1, pos+12 {
+        start := dirStart - int64(binary.LittleEndian.Uint32(dir[pos+4:pos+8]))
+        if start < 0 {
+            continue
+        }
+        header := make([]byte, 8+len(samsungMotionMarker))
+        if _, err := r.ReadAt(header, start); err != nil {
+            continue
+        }
+        nameLength := int64(binary.LittleEndian.Uint32(header[4:8]))
+        if nameLength == int64(len(samsungMotionMarker)) && bytes.Equal(header[8:], samsungMotionMarker) {
+            return start + 8 + nameLength, true
+        }
+    }
+    return 0, false
+}
+
+// isLivePhoto tells whether a still and a video are the two parts of a Live
+// Photo.
+func isLivePhoto(still, video MediaMetadata) bool {
+    if still.ContentID != "" && video.ContentID != "" {
+        return still.ContentID == video.ContentID
+    }
+    if video.Duration <= 0 || video.Duration > maxMotionDuration || still.DateTime.IsZero() || video.DateTime.IsZero() {
+        return false
+    }
+    // Videos may be in another time zone than stills without an offset,
+    // compare the clock times
+    diff := withWallClock(still.DateTime, time.UTC).Sub(withWallClock(video.DateTime, time.UTC))
+    return diff > -maxMotionTimeDiff && diff < maxMotionTimeDiff
+}
+
+// findLiveStill returns the still next to a video at its source, if the
+// video is the motion part of a Live Photo.
+func findLiveStill(path string, metadata MediaMetadata) (string, bool) {
+    names, err := listSiblings(filepath.Dir(path))
+    if err != nil {
+        logger.Printf("Warning: Could not look for the still of %s: %v\n", path, err)
+        return "", false
+    }
+    stem := pairStem(path)
+    for _, name := range names {
+        if fileType, _ := isMediaFile(name); fileType != "image" || pairStem(name) != stem {
+            continue
+        }
+        stillPath := filepath.Join(filepath.Dir(path), name)
+        stillMetadata, err := getMediaMetadata(stillPath, stillPath)
+        if err != nil {
+            logger.Printf("Warning: Could not read metadata of %s: %v\n", stillPath, err)
+            continue
+        }
+        if isLivePhoto(stillMetadata, metadata) {
+            return stillPath, true
+        }
+    }
+    return "", false
+}
+
+// findMotionPartner looks up the other part of a Live Photo in the database.
+func findMotionPartner(db *sql.DB, sourcePath string, metadata MediaMetadata) (pairPartner, bool, error) {
+    var partnerType string
+    switch metadata.FileType {
+    case "image":
+        partnerType = "video"
+    case "video":
+        partnerType = "image"
+    default:
+        return pairPartner{}, false, nil
+    }
+    if metadata.DateTime.IsZero() {
+        return pairPartner{}, false, nil
+    }
+    from := metadata.DateTime.Add(-maxMotionTimeDiff).Format(pairTimeLayout)
+    to := metadata.DateTime.Add(maxMotionTimeDiff).Format(pairTimeLayout)
+    rows, err := db.Query(`SELECT id, COALESCE(shot_id, 0), original_path, new_path, date_taken, COALESCE(duration, 0), COALESCE(content_id, '')
+        FROM media
+        WHERE file_type = ? AND (content_id = ? OR (date_taken >= ? AND date_taken < ?)) AND status != ? AND COALESCE(motion_role, '') != ?`,
+        partnerType, metadata.ContentID, from, to, mediaMissing, motionEmbedded)
+    if err != nil {
+        return pairPartner{}, false, err
+    }
+    defer rows.Close()
+    stem := pairStem(sourcePath)
+    for rows.Next() {
+        partner := pairPartner{fileType: partnerType}
+        var originalPath string
+        other := MediaMetadata{FileType: partnerType}
+        if err := rows.Scan(&partner.id, &partner.shotID, &originalPath, &partner.newPath, &other.DateTime, &other.Duration, &other.ContentID); err != nil {
+            return pairPartner{}, false, err
+        }
+        // Files with the same content identifier belong together even if
+        // one of them was renamed
+        sameContent := metadata.ContentID != "" && other.ContentID == metadata.ContentID
+        if pairStem(originalPath) != stem && !sameContent {
+            continue
+        }
+        still, video := metadata, other
+        if metadata.FileType == "video" {
+            still, video = other, metadata
+        }
+        if isLivePhoto(still, video) {
+            return partner, true, nil
+        }
+    }
+    return pairPartner{}, false, rows.Err()
+}
+
+// linkMotion links a newly stored file with the other part of its Live
+// Photo and records which is the still and which the video.
+func linkMotion(db dbExecer, hash uint64, partner pairPartner) error {
+    if err := linkPair(db, hash, partner); err != nil {
+        return err
+    }
+    _, err := db.Exec(`UPDATE media SET motion_role = CASE WHEN file_type = 'video' THEN ? ELSE ? END WHERE id = ? OR hash = ?`,
+        motionVideo, motionStill, partner.id, int64(hash))
+    return err
+}
+
+func setMotionRole(db dbExecer, hash uint64, role string) error {
+    _, err := db.Exec(`UPDATE media SET motion_role = ? WHERE hash = ?`, role, int64(hash))
+    return err
+}
+
+// importMotionVideo extracts the video of a motion photo and imports it next
+// to its still. It runs on the single goroutine that commits imports.
+func importMotionVideo(still preparedMedia, destDir string, db *sql.DB) ImportResult {
+    base := filepath.Base(still.file.key)
+    name := strings.TrimSuffix(base, filepath.Ext(base)) + ".mp4"
+    member := still.file.key + "!/" + name
+
+    tempDir, err := os.MkdirTemp("", tempFilePrefix+"motion-")
+    if err != nil {
+        return ImportResult{Status: "error", Message: fmt.Sprintf("Error extracting motion photo video: %v", err), OriginalPath: member}
+    }
+    defer os.RemoveAll(tempDir)
+    path := filepath.Join(tempDir, name)
+    if err := extractEmbeddedVideo(still.sourcePath, still.motion, path); err != nil {
+        return ImportResult{Status: "error", Message: fmt.Sprintf("Error extracting motion photo video: %v", err), OriginalPath: member}
+    }
+
+    prepared := prepareMedia(importJob{sourcePath: path, file: sourceFile{key: member}}, db)
+    // The temporary file is not what the user knows
+    prepared.originalPath = member
+    if prepared.result == nil {
+        // The video is the same moment as the still, which has the better
+        // metadata
+        m := &prepared.metadata
+        m.DateTime, m.TZOffset, m.DateSource = still.metadata.DateTime, still.metadata.TZOffset, still.metadata.DateSource
+        m.CameraMake, m.CameraModel, m.CameraType = still.metadata.CameraMake, still.metadata.CameraModel, still.metadata.CameraType
+        if m.Latitude == nil && still.metadata.Latitude != nil {
+            m.setLocation(*still.metadata.Latitude, *still.metadata.Longitude, still.metadata.Altitude)
+            m.Country, m.Region, m.City = still.metadata.Country, still.metadata.Region, still.metadata.City
+        }
+        prepared.still = still.sourcePath
+    }
+    return commitMedia(prepared, destDir, db)
+}
+
+func extractEmbeddedVideo(path string, video embeddedVideo, target string) error {
+    source, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer source.Close()
+    out, err := os.Create(target)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(out, io.NewSectionReader(source, video.offset, video.length)); err != nil {
+        out.Close()
+        return err
+    }
+    return out.Close()
+}
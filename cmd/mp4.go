@@ -0,0 +1,338 @@
+package cmd
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// A small reader for ISO base media files (MP4, MOV, 3GP, M4V). It only looks
+// at the boxes that carry metadata and never reads sample data, so it is
+// cheap even for large videos.
+
+// maxMetaBoxSize limits how much of a metadata box is read into memory.
+const maxMetaBoxSize = 4 << 20
+
+// mp4Epoch is the zero time of the mvhd timestamps.
+var mp4Epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// udtaKeys maps the QuickTime user data and iTunes item atoms to the tag
+// names ffprobe uses for them.
+var udtaKeys = map[string]string{
+    "\xa9xyz": "location",
+    "\xa9mak": "make",
+    "\xa9mod": "model",
+    "\xa9swr": "software",
+    "\xa9too": "encoder",
+    "\xa9day": "date",
+    "\xa9nam": "title",
+    "\xa9cmt": "comment",
+}
+
+// videoProbe is what a container parser found out about a video. Tags use
+// the names ffprobe reports for the format, so the native parser and
+// ffprobe can be used interchangeably.
+type videoProbe struct {
+    width    int
+    height   int
+    duration float64 // seconds
+    tags     map[string]string
+}
+
+// isISOBMFF reports whether the extension belongs to the MP4 family.
+func isISOBMFF(path string) bool {
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".mp4", ".mov", ".m4v", ".3gp", ".3g2", ".qt":
+        return true
+    }
+    return false
+}
+
+// mp4Box is the position of a box's payload within the file.
+type mp4Box struct {
+    boxType string
+    start   int64 // first byte after the header
+    end     int64
+}
+
+// readBoxes calls fn for each box between start and end.
+func readBoxes(r io.ReaderAt, start, end int64, fn func(box mp4Box) error) error {
+    header := make([]byte, 16)
+    for offset := start; offset+8 <= end; {
+        if _, err := r.ReadAt(header[:8], offset); err != nil {
+            return err
+        }
+        size := int64(binary.BigEndian.Uint32(header[:4]))
+        box := mp4Box{boxType: string(header[4:8]), start: offset + 8}
+        switch size {
+        case 0:
+            // Extends to the end of the enclosing box
+            size = end - offset
+        case 1:
+            if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+                return err
+            }
+            size = int64(binary.BigEndian.Uint64(header[8:16]))
+            box.start += 8
+        }
+        // Checked before adding, a huge size would wrap around
+        if size < box.start-offset || size > end-offset {
+            return fmt.Errorf("invalid %q box at offset %d", box.boxType, offset)
+        }
+        box.end = offset + size
+        if err := fn(box); err != nil {
+            return err
+        }
+        offset = box.end
+    }
+    return nil
+}
+
+// readBoxData returns the payload of a box.
+func readBoxData(r io.ReaderAt, box mp4Box) ([]byte, error) {
+    size := box.end - box.start
+    if size > maxMetaBoxSize {
+        return nil, fmt.Errorf("%q box too large (%d bytes)", box.boxType, size)
+    }
+    data := make([]byte, size)
+    _, err := r.ReadAt(data, box.start)
+    return data, err
+}
+
+// readMP4Metadata extracts creation time, duration, video dimensions and
+// the metadata tags from an MP4 or QuickTime file.
+func readMP4Metadata(path string) (videoProbe, error) {
+    probe := videoProbe{tags: make(map[string]string)}
+    file, err := os.Open(path)
+    if err != nil {
+        return probe, err
+    }
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil {
+        return probe, err
+    }
+
+    foundMoov := false
+    err = readBoxes(file, 0, info.Size(), func(box mp4Box) error {
+        if box.boxType != "moov" {
+            return nil
+        }
+        foundMoov = true
+        return readMoov(file, box, &probe)
+    })
+    if err != nil {
+        return probe, err
+    }
+    if !foundMoov {
+        return probe, fmt.Errorf("no moov box found")
+    }
+    return probe, nil
+}
+
+func readMoov(r io.ReaderAt, moov mp4Box, probe *videoProbe) error {
+    return readBoxes(r, moov.start, moov.end, func(box mp4Box) error {
+        switch box.boxType {
+        case "mvhd":
+            data, err := readBoxData(r, box)
+            if err != nil {
+                return err
+            }
+            parseMvhd(data, probe)
+        case "trak":
+            return readTrak(r, box, probe)
+        case "udta":
+            return readUdta(r, box, probe)
+        case "meta":
+            return readMeta(r, box, probe)
+        }
+        return nil
+    })
+}
+
+func parseMvhd(data []byte, probe *videoProbe) {
+    var created, timescale, duration uint64
+    switch {
+    case len(data) >= 32 && data[0] == 1:
+        created = binary.BigEndian.Uint64(data[4:12])
+        timescale = uint64(binary.BigEndian.Uint32(data[20:24]))
+        duration = binary.BigEndian.Uint64(data[24:32])
+    case len(data) >= 20:
+        created = uint64(binary.BigEndian.Uint32(data[4:8]))
+        timescale = uint64(binary.BigEndian.Uint32(data[12:16]))
+        duration = uint64(binary.BigEndian.Uint32(data[16:20]))
+    default:
+        return
+    }
+    if created != 0 {
+        t := mp4Epoch.Add(time.Duration(created) * time.Second)
+        probe.tags["creation_time"] = t.Format("2006-01-02T15:04:05.000000Z")
+    }
+    if timescale != 0 {
+        probe.duration = float64(duration) / float64(timescale)
+    }
+}
+
+// readTrak takes the dimensions of the first video track.
+func readTrak(r io.ReaderAt, trak mp4Box, probe *videoProbe) error {
+    if probe.width != 0 {
+        return nil
+    }
+    var width, height int
+    isVideo := false
+    err := readBoxes(r, trak.start, trak.end, func(box mp4Box) error {
+        switch box.boxType {
+        case "tkhd":
+            data, err := readBoxData(r, box)
+            if err != nil {
+                return err
+            }
+            // Width and height are 16.16 fixed point at the end of the box
+            offset := 76
+            if len(data) > 0 && data[0] == 1 {
+                offset = 88
+            }
+            if len(data) >= offset+8 {
+                width = int(binary.BigEndian.Uint32(data[offset:offset+4]) >> 16)
+                height = int(binary.BigEndian.Uint32(data[offset+4:offset+8]) >> 16)
+            }
+        case "mdia":
+            return readBoxes(r, box.start, box.end, func(child mp4Box) error {
+                if child.boxType != "hdlr" {
+                    return nil
+                }
+                data, err := readBoxData(r, child)
+                if err != nil {
+                    return err
+                }
+                isVideo = len(data) >= 12 && string(data[8:12]) == "vide"
+                return nil
+            })
+        }
+        return nil
+    })
+    if err == nil && isVideo {
+        probe.width, probe.height = width, height
+    }
+    return err
+}
+
+// readUdta reads QuickTime user data text atoms such as ©xyz and ©mak.
+func readUdta(r io.ReaderAt, udta mp4Box, probe *videoProbe) error {
+    return readBoxes(r, udta.start, udta.end, func(box mp4Box) error {
+        if box.boxType == "meta" {
+            return readMeta(r, box, probe)
+        }
+        key, ok := udtaKeys[box.boxType]
+        if !ok {
+            return nil
+        }
+        data, err := readBoxData(r, box)
+        if err != nil {
+            return err
+        }
+        // A 16 bit length and a language code precede the text
+        if len(data) >= 4 {
+            n := int(binary.BigEndian.Uint16(data[:2]))
+            if 4+n <= len(data) {
+                setTag(probe, key, string(data[4:4+n]))
+            }
+        }
+        return nil
+    })
+}
+
+// readMeta reads a metadata box, either QuickTime style with a keys box
+// naming the items (com.apple.quicktime.*, com.android.*) or iTunes style
+// with the item names as atom types.
+func readMeta(r io.ReaderAt, meta mp4Box, probe *videoProbe) error {
+    // In MP4 files meta is a full box with four bytes of version and flags
+    start := meta.start
+    var head [8]byte
+    if _, err := r.ReadAt(head[:], start); err == nil && binary.BigEndian.Uint32(head[:4]) == 0 {
+        start += 4
+    }
+
+    var keys []string
+    var ilst *mp4Box
+    err := readBoxes(r, start, meta.end, func(box mp4Box) error {
+        switch box.boxType {
+        case "keys":
+            data, err := readBoxData(r, box)
+            if err != nil {
+                return err
+            }
+            keys = parseKeys(data)
+        case "ilst":
+            b := box
+            ilst = &b
+        }
+        return nil
+    })
+    if err != nil || ilst == nil {
+        return err
+    }
+
+    return readBoxes(r, ilst.start, ilst.end, func(item mp4Box) error {
+        var key string
+        if keys != nil {
+            // Item types are 1-based indexes into the keys box
+            index := int(binary.BigEndian.Uint32([]byte(item.boxType)))
+            if index < 1 || index > len(keys) {
+                return nil
+            }
+            key = keys[index-1]
+        } else if k, ok := udtaKeys[item.boxType]; ok {
+            key = k
+        } else {
+            return nil
+        }
+        return readBoxes(r, item.start, item.end, func(box mp4Box) error {
+            if box.boxType != "data" {
+                return nil
+            }
+            data, err := readBoxData(r, box)
+            if err != nil {
+                return err
+            }
+            // Type indicator 1 is UTF-8 text, skip binary values
+            if len(data) >= 8 && binary.BigEndian.Uint32(data[:4])&0xffffff == 1 {
+                setTag(probe, key, string(data[8:]))
+            }
+            return nil
+        })
+    })
+}
+
+func parseKeys(data []byte) []string {
+    if len(data) < 8 {
+        return nil
+    }
+    // Every key takes at least 8 bytes, which bounds a corrupt count
+    count := binary.BigEndian.Uint32(data[4:8])
+    if limit := uint32(len(data) / 8); count > limit {
+        count = limit
+    }
+    keys := make([]string, 0, count)
+    for offset := 8; offset+8 <= len(data) && len(keys) < int(count); {
+        size := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+        if size < 8 || offset+size > len(data) {
+            break
+        }
+        keys = append(keys, string(data[offset+8:offset+size]))
+        offset += size
+    }
+    return keys
+}
+
+// setTag keeps the first value seen for a key, like ffprobe.
+func setTag(probe *videoProbe, key, value string) {
+    value = strings.TrimRight(value, "\x00")
+    if _, exists := probe.tags[key]; !exists && value != "" {
+        probe.tags[key] = value
+    }
+}
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+    "database/sql"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+// RAW+JPEG pairs: cameras set to record both write two files of the same
+// shot with the same base name, e.g. IMG_1234.CR2 and IMG_1234.JPG. The two
+// halves are linked in the database by a shared shot_id, the id of the half
+// imported first.
+
+// Values of --pairs
+const (
+    pairsSplit      = "split"        // RAW and JPEG go to their own trees
+    pairsSideBySide = "side-by-side" // the JPEG is placed like its RAW
+    pairsSkipJPEG   = "skip-jpeg"    // the JPEG is not imported
+)
+
+var pairMode string
+
+// pairTimeLayout is the capture time to the second, which both halves of a
+// pair share.
+const pairTimeLayout = "2006-01-02 15:04:05"
+
+func checkPairMode(mode string) error {
+    switch mode {
+    case pairsSplit, pairsSideBySide, pairsSkipJPEG:
+        return nil
+    }
+    return fmt.Errorf("unknown --pairs mode %q (use %s, %s or %s)", mode, pairsSplit, pairsSideBySide, pairsSkipJPEG)
+}
+
+// pairStem is the name both halves of a pair have in common.
+func pairStem(path string) string {
+    base := filepath.Base(path)
+    return strings.ToLower(strings.TrimSuffix(base, filepath.Ext(base)))
+}
+
+// sameShot tells whether two files were taken by the same camera at the same
+// second.
+func sameShot(a, b MediaMetadata) bool {
+    return a.CameraModel == b.CameraModel && !a.DateTime.IsZero() &&
+        a.DateTime.Format(pairTimeLayout) == b.DateTime.Format(pairTimeLayout)
+}
+
+// pairPartner is the other half of a pair that is already in the database.
+type pairPartner struct {
+    id       int64
+    shotID   int64
+    fileType string
+    newPath  string
+}
+
+// findPairPartner looks up the other half of an image in the database.
+func findPairPartner(db *sql.DB, sourcePath string, metadata MediaMetadata) (pairPartner, bool, error) {
+    var partnerType string
+    switch metadata.FileType {
+    case "image":
+        partnerType = "image_raw"
+    case "image_raw":
+        partnerType = "image"
+    default:
+        return pairPartner{}, false, nil
+    }
+    if metadata.DateTime.IsZero() {
+        return pairPartner{}, false, nil
+    }
+    // date_taken starts with the local time, so the second can be selected
+    // as a range of strings
+    second := metadata.DateTime.Format(pairTimeLayout)
+    next := metadata.DateTime.Add(time.Second).Format(pairTimeLayout)
+    rows, err := db.Query(`SELECT id, COALESCE(shot_id, 0), original_path, new_path FROM media
+        WHERE file_type = ? AND date_taken >= ? AND date_taken < ? AND COALESCE(camera_model, '') = ? AND status != ?`,
+        partnerType, second, next, metadata.CameraModel, mediaMissing)
+    if err != nil {
+        return pairPartner{}, false, err
+    }
+    defer rows.Close()
+    stem := pairStem(sourcePath)
+    for rows.Next() {
+        partner := pairPartner{fileType: partnerType}
+        var originalPath string
+        if err := rows.Scan(&partner.id, &partner.shotID, &originalPath, &partner.newPath); err != nil {
+            return pairPartner{}, false, err
+        }
+        if pairStem(originalPath) == stem {
+            return partner, true, nil
+        }
+    }
+    return pairPartner{}, false, rows.Err()
+}
+
+// linkPair gives a newly stored file and its partner the same shot_id.
+func linkPair(db dbExecer, hash uint64, partner pairPartner) error {
+    shotID := partner.shotID
+    if shotID == 0 {
+        shotID = partner.id
+    }
+    _, err := db.Exec(`UPDATE media SET shot_id = ? WHERE id = ? OR hash = ?`, shotID, partner.id, int64(hash))
+    return err
+}
+
+// The JPEGs of a folder are looked up one after the other, so the listing
+// of the last folder is kept.
+var (
+    siblingMu    sync.Mutex
+    siblingDir   string
+    siblingNames []string
+)
+
+func listSiblings(dir string) ([]string, error) {
+    siblingMu.Lock()
+    defer siblingMu.Unlock()
+    if dir == siblingDir {
+        return siblingNames, nil
+    }
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    var names []string
+    for _, entry := range entries {
+        if !entry.IsDir() {
+            names = append(names, entry.Name())
+        }
+    }
+    siblingDir, siblingNames = dir, names
+    return names, nil
+}
+
+// findRawSibling returns the RAW file next to an image at its source that
+// was taken together with it, so that a pair is known even while its RAW
+// half is still on its way into the database.
+func findRawSibling(path string, metadata MediaMetadata) (string, bool) {
+    names, err := listSiblings(filepath.Dir(path))
+    if err != nil {
+        logger.Printf("Warning: Could not look for the RAW file of %s: %v\n", path, err)
+        return "", false
+    }
+    stem := pairStem(path)
+    for _, name := range names {
+        if fileType, _ := isMediaFile(name); fileType != "image_raw" || pairStem(name) != stem {
+            continue
+        }
+        rawPath := filepath.Join(filepath.Dir(path), name)
+        rawMetadata, err := getMediaMetadata(rawPath, rawPath)
+        if err != nil {
+            logger.Printf("Warning: Could not read metadata of %s: %v\n", rawPath, err)
+            continue
+        }
+        if sameShot(metadata, rawMetadata) {
+            return rawPath, true
+        }
+    }
+    return "", false
+}
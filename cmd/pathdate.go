@@ -0,0 +1,142 @@
+package cmd
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Capture dates from file and folder names, for files whose metadata has no
+// date, e.g. after passing through messaging apps or cloud services that
+// strip it. Such names are the local time of the device.
+
+// datePatterns find dates in names like IMG_20210704_153012.jpg,
+// PXL_20210704_153012345.jpg, VID-20210704-WA0001.mp4,
+// Screenshot_2021-07-04-15-30-12.png or "2021-07-04 Beach". The year must
+// be 19xx or 20xx and the date must not be part of a longer number.
+var datePatterns = []*regexp.Regexp{
+    regexp.MustCompile(`(?:^|\D)(?P<year>(?:19|20)\d\d)[-_.]?(?P<month>\d\d)[-_.]?(?P<day>\d\d)[-_ T.]?(?P<hour>\d\d)[-_.:h]?(?P<minute>\d\d)[-_.:m]?(?P<second>\d\d)`),
+    regexp.MustCompile(`(?:^|\D)(?P<year>(?:19|20)\d\d)[-_.]?(?P<month>\d\d)[-_.]?(?P<day>\d\d)(?:\D|$)`),
+}
+
+// extraDatePatterns are the --date-pattern expressions, tried first.
+var extraDatePatterns []*regexp.Regexp
+
+var datePatternFlags []string
+
+// maxDateFolderDepth is how many parent folders are looked at for a date.
+const maxDateFolderDepth = 3
+
+// setupDatePatterns compiles the --date-pattern expressions. They must name
+// at least the year, month and day groups.
+func setupDatePatterns(patterns []string) error {
+    extraDatePatterns = nil
+    for _, pattern := range patterns {
+        re, err := regexp.Compile(pattern)
+        if err != nil {
+            return fmt.Errorf("invalid date pattern %q: %w", pattern, err)
+        }
+        for _, group := range []string{"year", "month", "day"} {
+            if re.SubexpIndex(group) < 0 {
+                return fmt.Errorf("date pattern %q has no (?P<%s>...) group", pattern, group)
+            }
+        }
+        extraDatePatterns = append(extraDatePatterns, re)
+    }
+    return nil
+}
+
+// dateFromPath looks for a date in the file name, then in the names of the
+// folders above it, nearest first.
+func dateFromPath(path string) (time.Time, string, bool) {
+    base := filepath.Base(path)
+    if t, ok := parseNameDate(strings.TrimSuffix(base, filepath.Ext(base))); ok {
+        return t, dateFromFilename, true
+    }
+    dir := filepath.Dir(path)
+    for i := 0; i < maxDateFolderDepth; i++ {
+        name := filepath.Base(dir)
+        if name == "." || name == string(filepath.Separator) || name == dir {
+            break
+        }
+        if t, ok := parseNameDate(name); ok {
+            return t, dateFromFolder, true
+        }
+        dir = filepath.Dir(dir)
+    }
+    return time.Time{}, "", false
+}
+
+// parseNameDate returns the first valid date found by the patterns.
+func parseNameDate(name string) (time.Time, bool) {
+    for _, patterns := range [][]*regexp.Regexp{extraDatePatterns, datePatterns} {
+        for _, re := range patterns {
+            for _, match := range re.FindAllStringSubmatch(name, -1) {
+                if t, ok := dateFromMatch(re, match); ok {
+                    return t, true
+                }
+            }
+        }
+    }
+    return time.Time{}, false
+}
+
+func dateFromMatch(re *regexp.Regexp, match []string) (time.Time, bool) {
+    group := func(name string) int {
+        i := re.SubexpIndex(name)
+        if i < 0 || match[i] == "" {
+            return 0
+        }
+        n, err := strconv.Atoi(match[i])
+        if err != nil {
+            return -1
+        }
+        return n
+    }
+    year, month, day := group("year"), group("month"), group("day")
+    hour, minute, second := group("hour"), group("minute"), group("second")
+    // Two digit years from --date-pattern
+    if len(match[re.SubexpIndex("year")]) == 2 {
+        year += 2000
+    }
+    if year < 1900 || month < 1 || month > 12 || day < 1 || hour < 0 || hour > 23 || minute < 0 || minute > 59 || second < 0 || second > 59 {
+        return time.Time{}, false
+    }
+    t := time.Date(year, time.Month(month), day, hour, minute, second, 0, time.UTC)
+    // Reject dates such as February 30th, and dates in the future
+    if t.Day() != day || t.After(time.Now().AddDate(0, 0, 1)) {
+        return time.Time{}, false
+    }
+    return t, true
+}
+
+// setFallbackDate dates a file without a date in its metadata from its name,
+// or else from its modification time. name is the path of the file at its
+// source, which may differ from path for archive members.
+func setFallbackDate(path, name string, metadata *MediaMetadata) {
+    if t, source, ok := dateFromPath(name); ok {
+        metadata.DateTime = t
+        metadata.DateSource = source
+        if defaultTimeZone != nil {
+            metadata.DateTime = withWallClock(t, defaultTimeZone)
+            metadata.setTimeZone()
+        }
+        return
+    }
+    file, err := os.Open(path)
+    if err != nil {
+        logger.Printf("Warning: Could not get modification time for %s: %v\n", path, err)
+        return
+    }
+    defer file.Close()
+    metadata.DateTime, err = getModificationTime(file)
+    if err != nil {
+        logger.Printf("Warning: Could not get modification time for %s: %v\n", path, err)
+        return
+    }
+    metadata.DateSource = dateFromMtime
+}
@@ -0,0 +1,265 @@
+package cmd
+
+import (
+    "context"
+    "database/sql"
+    "runtime"
+    "sync"
+)
+
+// importJob is a single source file queued for import.
+type importJob struct {
+    sourcePath string
+    file       sourceFile
+    done       func() // called once the file has been committed or dropped, may be nil
+    inPlace    bool   // the file is already in the library and stays where it is
+    staged     bool   // an archive member written to the staging folder, moved into place
+    hash       uint64 // computed while staging, 0 if not known yet
+    head       []byte // first bytes of a staged file
+    archive    string // key of the archive a staged file is from
+}
+
+// preparedMedia carries the outcome of prepareMedia from a worker to the
+// DB writer. If result is set the file needs no further processing.
+type preparedMedia struct {
+    sourcePath   string
+    originalPath string // recorded as original_path if not sourcePath
+    file         sourceFile
+    fileType     string
+    hash         uint64
+    metadata     MediaMetadata
+    inPlace      bool
+    staged       bool
+    rawSibling   string   // RAW file taken together with this image, if any
+    sidecars     []string // sidecar files next to the source
+    still        string   // still of the Live Photo this video belongs to, if any
+    motion       embeddedVideo // video embedded in a motion photo
+    archive      string // key of the archive the file is from, if any
+    noTakeout    bool   // --takeout found no JSON file for the archive member yet
+    result       *ImportResult
+}
+
+func (p preparedMedia) resolve(result ImportResult) preparedMedia {
+    p.result = &result
+    return p
+}
+
+type preparedJob struct {
+    job      importJob
+    prepared preparedMedia
+}
+
+// importPipeline fans hashing and metadata extraction out to a pool of
+// workers. Everything that writes to the library, the database or the
+// statistics happens on a single writer goroutine.
+type importPipeline struct {
+    ctx      context.Context
+    destDir  string
+    db       *sql.DB
+    stats    *ImportStats
+    jobs     chan importJob
+    prepared chan preparedJob
+    workers  sync.WaitGroup
+    writer   sync.WaitGroup
+
+    // With --pairs skip-jpeg a JPEG whose RAW file has not been through the
+    // writer yet waits for it, by the source path of the RAW, so that it is
+    // only skipped if its RAW made it into the library. seenRaw holds the
+    // RAW files that have been.
+    deferred map[string][]preparedJob
+    seenRaw  map[string]bool
+
+    // With --takeout archive members whose JSON file has not been found
+    // wait for it while their archive is read, which may be further on in
+    // a tar file. They are kept in waiting by archive key, reading holds
+    // the archives that are being read. The walk tells the writer through
+    // takeout when a JSON file was read or an archive is done.
+    takeout   chan takeoutEvent
+    readingMu sync.Mutex
+    reading   map[string]bool
+    waiting   map[string][]preparedJob
+    // lateTakeout holds the members imported without their JSON file, which
+    // may be in a later part of the export. Only read after wait.
+    lateTakeout []takeoutLate
+}
+
+type takeoutEvent struct {
+    archive string
+    done    bool // the archive has been read, otherwise a JSON file was
+}
+
+func newImportPipeline(ctx context.Context, destDir string, db *sql.DB, stats *ImportStats, numWorkers int) *importPipeline {
+    if numWorkers <= 0 {
+        numWorkers = runtime.NumCPU()
+    }
+    p := &importPipeline{
+        ctx:      ctx,
+        destDir:  destDir,
+        db:       db,
+        stats:    stats,
+        jobs:     make(chan importJob, numWorkers),
+        prepared: make(chan preparedJob, numWorkers),
+        deferred: make(map[string][]preparedJob),
+        seenRaw:  make(map[string]bool),
+        takeout:  make(chan takeoutEvent),
+        reading:  make(map[string]bool),
+        waiting:  make(map[string][]preparedJob),
+    }
+    p.workers.Add(numWorkers)
+    for i := 0; i < numWorkers; i++ {
+        go p.work()
+    }
+    p.writer.Add(1)
+    go p.write()
+    return p
+}
+
+// submit queues a job, blocking while all workers are busy.
+func (p *importPipeline) submit(job importJob) error {
+    select {
+    case p.jobs <- job:
+        return nil
+    case <-p.ctx.Done():
+        return context.Canceled
+    }
+}
+
+// wait drains the pipeline. No jobs may be submitted afterwards.
+func (p *importPipeline) wait() {
+    close(p.jobs)
+    p.workers.Wait()
+    close(p.prepared)
+    p.writer.Wait()
+}
+
+func (p *importPipeline) work() {
+    defer p.workers.Done()
+    for job := range p.jobs {
+        // After cancellation queued jobs are only drained
+        if p.ctx.Err() != nil {
+            job.finish()
+            continue
+        }
+        p.prepared <- preparedJob{job: job, prepared: prepareMedia(job, p.db)}
+    }
+}
+
+// startArchive and endArchive bracket the reading of an archive whose
+// Takeout JSON files are read during the import.
+func (p *importPipeline) startArchive(archive string) {
+    p.readingMu.Lock()
+    defer p.readingMu.Unlock()
+    p.reading[archive] = true
+}
+
+func (p *importPipeline) endArchive(archive string) {
+    p.readingMu.Lock()
+    delete(p.reading, archive)
+    p.readingMu.Unlock()
+    p.takeout <- takeoutEvent{archive: archive, done: true}
+}
+
+// takeoutJSONRead tells the writer that a JSON file of archive was read.
+func (p *importPipeline) takeoutJSONRead(archive string) {
+    p.takeout <- takeoutEvent{archive: archive}
+}
+
+func (p *importPipeline) write() {
+    defer p.writer.Done()
+    for {
+        select {
+        case item, ok := <-p.prepared:
+            if !ok {
+                // RAW files that were not imported in this run, e.g. because
+                // an earlier run of the session already did
+                for _, items := range p.deferred {
+                    for _, jpeg := range items {
+                        p.commit(jpeg)
+                    }
+                }
+                return
+            }
+            if p.waitsForTakeout(item) {
+                archive := item.prepared.archive
+                // Only the metadata is needed from here on
+                item.job.head = nil
+                p.waiting[archive] = append(p.waiting[archive], item)
+                continue
+            }
+            p.handle(item)
+        case event := <-p.takeout:
+            var still []preparedJob
+            for _, item := range p.waiting[event.archive] {
+                if event.done || !p.waitsForTakeout(item) {
+                    p.handle(item)
+                } else {
+                    still = append(still, item)
+                }
+            }
+            if len(still) > 0 {
+                p.waiting[event.archive] = still
+            } else {
+                delete(p.waiting, event.archive)
+            }
+        }
+    }
+}
+
+// waitsForTakeout tells whether a member of an archive that is still being
+// read has no Takeout JSON file yet.
+func (p *importPipeline) waitsForTakeout(item preparedJob) bool {
+    prepared := item.prepared
+    if !prepared.noTakeout || p.ctx.Err() != nil {
+        return false
+    }
+    p.readingMu.Lock()
+    reading := p.reading[prepared.archive]
+    p.readingMu.Unlock()
+    return reading && findTakeoutJSON(prepared.sourcePath, prepared.file.key) == nil
+}
+
+func (p *importPipeline) handle(item preparedJob) {
+    if raw := item.prepared.rawSibling; pairMode == pairsSkipJPEG && raw != "" && !p.seenRaw[raw] {
+        p.deferred[raw] = append(p.deferred[raw], item)
+        return
+    }
+    p.commit(item)
+    if item.prepared.fileType == "image_raw" {
+        p.seenRaw[item.prepared.sourcePath] = true
+        for _, jpeg := range p.deferred[item.prepared.sourcePath] {
+            p.commit(jpeg)
+        }
+        delete(p.deferred, item.prepared.sourcePath)
+    }
+}
+
+func (p *importPipeline) commit(item preparedJob) {
+    if p.ctx.Err() == nil {
+        late := false
+        if item.prepared.noTakeout && item.prepared.result == nil {
+            // The JSON file may have been read since prepareMedia
+            late = !applyTakeoutMetadata(item.prepared.sourcePath, item.prepared.file.key, &item.prepared.metadata)
+        }
+        result := commitMedia(item.prepared, p.destDir, p.db)
+        updateStats(result, p.stats)
+        if late && result.Status == "imported" && !dryRun {
+            p.lateTakeout = append(p.lateTakeout, takeoutLate{hash: item.prepared.hash, key: item.prepared.file.key, metadata: item.prepared.metadata})
+        }
+        if extractMotion && item.prepared.motion.length > 0 && result.Status == "imported" {
+            still := item.prepared
+            if !dryRun {
+                // Read the video from the library copy, with --move or for
+                // archive members the source is gone
+                still.sourcePath = result.NewPath
+            }
+            updateStats(importMotionVideo(still, p.destDir, p.db), p.stats)
+        }
+    }
+    item.job.finish()
+}
+
+func (j importJob) finish() {
+    if j.done != nil {
+        j.done()
+    }
+}
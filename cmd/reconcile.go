@@ -0,0 +1,241 @@
+package cmd
+
+import (
+    "database/sql"
+    "fmt"
+    "os"
+    "path/filepath"
+
+    "github.com/spf13/cobra"
+)
+
+var reconcileCmd = &cobra.Command{
+    Use:   "reconcile [archive_directory]",
+    Short: "Find differences between the library files and the database",
+    Long: `Compare the files under the library with media.db. Reports media files that
+are not in the database (orphans, e.g. copied in by hand), entries whose file
+no longer exists (dead rows, e.g. deleted in a file manager), and files that
+were moved within the library.
+
+Without options nothing is changed. --adopt adds orphans to the database
+where they are and updates the path of moved files, --mark-missing marks dead
+rows as missing and --purge deletes them.`,
+    Args:        cobra.ExactArgs(1),
+    Annotations: map[string]string{libraryArgAnnotation: "0"},
+    Run: func(cmd *cobra.Command, args []string) {
+        destDir := args[0]
+        reconcileLibrary(destDir)
+    },
+}
+
+var (
+    adoptOrphans bool
+    markMissing  bool
+    purgeMissing bool
+)
+
+func init() {
+    rootCmd.AddCommand(reconcileCmd)
+    reconcileCmd.Flags().BoolVar(&adoptOrphans, "adopt", false, "Add orphan files to the database in place and update the path of moved files")
+    reconcileCmd.Flags().BoolVar(&markMissing, "mark-missing", false, "Mark entries whose file no longer exists as missing")
+    reconcileCmd.Flags().BoolVar(&purgeMissing, "purge", false, "Delete entries whose file no longer exists")
+    reconcileCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "Show what would be changed without changing anything")
+}
+
+type libraryRow struct {
+    id      int64
+    hash    uint64
+    newPath string
+    status  string
+}
+
+func reconcileLibrary(destDir string) {
+    if markMissing && purgeMissing {
+        fmt.Printf("Error: --mark-missing and --purge cannot be combined\n")
+        return
+    }
+    db, err := initDB(destDir)
+    if err != nil {
+        fmt.Printf("Error opening database: %v\n", err)
+        return
+    }
+    defer db.Close()
+
+    absDest, err := filepath.Abs(destDir)
+    if err != nil {
+        fmt.Printf("Error resolving %s: %v\n", destDir, err)
+        return
+    }
+
+    rows, err := loadLibraryRows(db)
+    if err != nil {
+        fmt.Printf("Error querying database: %v\n", err)
+        return
+    }
+
+    // Rows are matched to files by absolute path, pending rows are left to
+    // the repair done by the next import
+    known := make(map[string]bool)
+    var dead, restored []libraryRow
+    for _, row := range rows {
+        path := absPath(row.newPath)
+        known[path] = true
+        if row.status == mediaPending {
+            continue
+        }
+        _, err := os.Stat(path)
+        exists := err == nil
+        switch {
+        case !exists:
+            dead = append(dead, row)
+        case row.status == mediaMissing:
+            restored = append(restored, row)
+        }
+    }
+
+    var orphans []string
+    err = filepath.Walk(absDest, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            fmt.Printf("Error accessing %s: %v\n", path, err)
+            return nil
+        }
+        if info.IsDir() {
+            if info.Name() == stagingDirName {
+                // Archive members of a running import
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if _, isMedia := isMediaFile(path); isMedia && !known[path] {
+            // Spelled like the paths written by import
+            rel, err := filepath.Rel(absDest, path)
+            if err == nil {
+                path = filepath.Join(destDir, rel)
+            }
+            orphans = append(orphans, path)
+        }
+        return nil
+    })
+    if err != nil {
+        fmt.Printf("Error walking %s: %v\n", destDir, err)
+        return
+    }
+
+    // An orphan with the hash of a dead row is the same file in a new place
+    deadByHash := make(map[uint64]libraryRow)
+    for _, row := range dead {
+        deadByHash[row.hash] = row
+    }
+    moved := make(map[int64]bool)
+    var adopted, movedCount, orphanCount, errors int
+    for _, path := range orphans {
+        if len(deadByHash) > 0 {
+            hash, err := computeXXHash(path)
+            if err != nil {
+                fmt.Printf("Error computing hash of %s: %v\n", path, err)
+                errors++
+                continue
+            }
+            if row, ok := deadByHash[hash]; ok && !moved[row.id] {
+                moved[row.id] = true
+                movedCount++
+                fmt.Printf("MOVED    %s -> %s\n", row.newPath, path)
+                if adoptOrphans && !dryRun {
+                    _, err := db.Exec(`UPDATE media SET new_path = ?, status = ? WHERE id = ?`, path, mediaOK, row.id)
+                    if err != nil {
+                        fmt.Printf("Error updating record for %s: %v\n", path, err)
+                        errors++
+                    }
+                }
+                continue
+            }
+        }
+
+        orphanCount++
+        fmt.Printf("ORPHAN   %s\n", path)
+        if !adoptOrphans || dryRun {
+            continue
+        }
+        result := adoptMedia(path, destDir, db)
+        switch result.Status {
+        case "imported_existing":
+            adopted++
+        case "skipped_in_db":
+            fmt.Printf("         not adopted, %s\n", result.Message)
+        default:
+            fmt.Printf("         not adopted: %s\n", result.Message)
+            errors++
+        }
+    }
+
+    var missingCount int
+    for _, row := range dead {
+        if moved[row.id] {
+            continue
+        }
+        missingCount++
+        fmt.Printf("MISSING  %s\n", row.newPath)
+        if dryRun {
+            continue
+        }
+        var err error
+        if purgeMissing {
+            _, err = db.Exec(`DELETE FROM media WHERE id = ?`, row.id)
+        } else if markMissing && row.status != mediaMissing {
+            _, err = db.Exec(`UPDATE media SET status = ? WHERE id = ?`, mediaMissing, row.id)
+        }
+        if err != nil {
+            fmt.Printf("Error updating record for %s: %v\n", row.newPath, err)
+            errors++
+        }
+    }
+
+    // Files marked missing that have come back are regular entries again
+    for _, row := range restored {
+        fmt.Printf("RESTORED %s\n", row.newPath)
+        if !dryRun {
+            if _, err := db.Exec(`UPDATE media SET status = ? WHERE id = ?`, mediaOK, row.id); err != nil {
+                fmt.Printf("Error updating record for %s: %v\n", row.newPath, err)
+                errors++
+            }
+        }
+    }
+
+    fmt.Printf("Reconcile complete. Orphans: %d, Missing: %d, Moved: %d, Restored: %d, Errors: %d\n",
+        orphanCount, missingCount, movedCount, len(restored), errors)
+    switch {
+    case dryRun:
+        fmt.Println("Dry run, nothing was changed.")
+    case adoptOrphans:
+        fmt.Printf("Adopted %d orphan files.\n", adopted)
+    }
+}
+
+func loadLibraryRows(db *sql.DB) ([]libraryRow, error) {
+    rows, err := db.Query(`SELECT id, hash, new_path, status FROM media`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var result []libraryRow
+    for rows.Next() {
+        var row libraryRow
+        var hash int64
+        if err := rows.Scan(&row.id, &hash, &row.newPath, &row.status); err != nil {
+            return nil, err
+        }
+        row.hash = uint64(hash)
+        result = append(result, row)
+    }
+    return result, rows.Err()
+}
+
+// absPath returns path as an absolute path, or unchanged if that fails.
+func absPath(path string) string {
+    abs, err := filepath.Abs(path)
+    if err != nil {
+        return path
+    }
+    return abs
+}
@@ -0,0 +1,252 @@
+package cmd
+
+import (
+    "database/sql"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Journal states of a source file within an import session. A file moves
+// through hashed -> recorded -> copied -> verified, or ends up skipped.
+const (
+    journalHashed   = "hashed"   // hash is known, nothing written yet
+    journalRecorded = "recorded" // row inserted in media, file not yet in place
+    journalCopied   = "copied"   // file written to new_path
+    journalVerified = "verified" // file confirmed at new_path, done
+    journalSkipped  = "skipped"  // duplicate, too small or not media, done
+)
+
+// A running session updates its heartbeat regularly. A session that is
+// still marked running but has not done so for sessionStaleAfter was killed
+// before it could record that it stopped.
+const (
+    sessionHeartbeatInterval = 30 * time.Second
+    sessionStaleAfter        = 2 * time.Minute
+)
+
+// importSession is the persistent journal of one import run. It lets an
+// interrupted import be resumed without re-hashing finished files, and lets
+// half-finished files be rolled back or completed.
+type importSession struct {
+    id        int64
+    sourceDir string
+    db        *sql.DB
+    // entries holds the journal from previous runs of a resumed session. It
+    // is only read once the import has started.
+    entries map[string]journalEntry
+    // stop ends the heartbeat
+    stop chan struct{}
+}
+
+type journalEntry struct {
+    size    int64
+    modTime int64
+    hash    uint64
+    state   string
+}
+
+// sourceFile identifies a file to import in the journal. For archive
+// members key is the archive path followed by "!/" and the member name.
+type sourceFile struct {
+    key     string
+    size    int64
+    modTime time.Time
+}
+
+func newSourceFile(path string, info os.FileInfo) sourceFile {
+    return sourceFile{key: path, size: info.Size(), modTime: info.ModTime()}
+}
+
+func startSession(db *sql.DB, sourceDir string) (*importSession, error) {
+    absSource, err := filepath.Abs(sourceDir)
+    if err != nil {
+        return nil, err
+    }
+    res, err := db.Exec(`INSERT INTO import_sessions (source_dir, started_at, status, heartbeat) VALUES (?, ?, 'running', ?)`,
+        absSource, time.Now(), time.Now().Unix())
+    if err != nil {
+        return nil, fmt.Errorf("error creating import session: %w", err)
+    }
+    id, err := res.LastInsertId()
+    if err != nil {
+        return nil, err
+    }
+    session := &importSession{id: id, sourceDir: absSource, db: db, entries: map[string]journalEntry{}}
+    session.startHeartbeat()
+    return session, nil
+}
+
+// resumeSession reopens an unfinished session and loads its journal.
+func resumeSession(db *sql.DB, id int64) (*importSession, error) {
+    session := &importSession{id: id, db: db, entries: map[string]journalEntry{}}
+    var status string
+    err := db.QueryRow(`SELECT source_dir, status FROM import_sessions WHERE id = ?`, id).Scan(&session.sourceDir, &status)
+    if err == sql.ErrNoRows {
+        return nil, fmt.Errorf("import session %d not found", id)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if status == "completed" {
+        return nil, fmt.Errorf("import session %d already completed", id)
+    }
+
+    rows, err := db.Query(`SELECT source_path, size, mod_time, hash, state FROM import_journal WHERE session_id = ?`, id)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var key string
+        var entry journalEntry
+        var hash int64
+        if err := rows.Scan(&key, &entry.size, &entry.modTime, &hash, &entry.state); err != nil {
+            return nil, err
+        }
+        entry.hash = uint64(hash)
+        session.entries[key] = entry
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+
+    _, err = db.Exec(`UPDATE import_sessions SET status = 'running', finished_at = NULL, heartbeat = ? WHERE id = ?`,
+        time.Now().Unix(), id)
+    if err != nil {
+        return nil, err
+    }
+    session.startHeartbeat()
+    return session, nil
+}
+
+func (s *importSession) startHeartbeat() {
+    s.stop = make(chan struct{})
+    go func() {
+        ticker := time.NewTicker(sessionHeartbeatInterval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-s.stop:
+                return
+            case now := <-ticker.C:
+                _, err := s.db.Exec(`UPDATE import_sessions SET heartbeat = ? WHERE id = ?`, now.Unix(), s.id)
+                if err != nil {
+                    logger.Printf("Error updating import session %d: %v\n", s.id, err)
+                }
+            }
+        }
+    }()
+}
+
+func (s *importSession) finish(status string) {
+    if s == nil {
+        return
+    }
+    close(s.stop)
+    _, err := s.db.Exec(`UPDATE import_sessions SET status = ?, finished_at = ? WHERE id = ?`, status, time.Now(), s.id)
+    if err != nil {
+        logger.Printf("Error updating import session %d: %v\n", s.id, err)
+    }
+}
+
+// lookup returns the journal entry of an unchanged source file.
+func (s *importSession) lookup(file sourceFile) (journalEntry, bool) {
+    if s == nil {
+        return journalEntry{}, false
+    }
+    entry, ok := s.entries[file.key]
+    if !ok || entry.size != file.size || entry.modTime != file.modTime.UnixNano() {
+        return journalEntry{}, false
+    }
+    return entry, true
+}
+
+// isDone reports whether an earlier run of the session finished the file.
+func (s *importSession) isDone(file sourceFile) bool {
+    entry, ok := s.lookup(file)
+    return ok && (entry.state == journalVerified || entry.state == journalSkipped)
+}
+
+// mark records the state of a file. ex is the session database or a
+// transaction on it.
+func (s *importSession) mark(ex dbExecer, file sourceFile, hash uint64, state, newPath string) error {
+    if s == nil {
+        return nil
+    }
+    _, err := ex.Exec(`
+        INSERT INTO import_journal (session_id, source_path, size, mod_time, hash, state, new_path)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT (session_id, source_path) DO UPDATE SET
+            size = excluded.size, mod_time = excluded.mod_time, hash = excluded.hash,
+            state = excluded.state, new_path = excluded.new_path`,
+        s.id, file.key, file.size, file.modTime.UnixNano(), int64(hash), state, newPath)
+    return err
+}
+
+// liveSessions returns the ids of the sessions an import is still running.
+func liveSessions(db *sql.DB) (map[int64]bool, error) {
+    rows, err := db.Query(`SELECT id FROM import_sessions WHERE status = 'running' AND heartbeat >= ?`,
+        time.Now().Add(-sessionStaleAfter).Unix())
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    live := map[int64]bool{}
+    for rows.Next() {
+        var id int64
+        if err := rows.Scan(&id); err != nil {
+            return nil, err
+        }
+        live[id] = true
+    }
+    return live, rows.Err()
+}
+
+// tempFilePattern names the temporary files of copyFile after the session
+// writing them, so that their leftovers can be told apart from files another
+// import is still writing.
+func tempFilePattern() string {
+    if currentSession == nil {
+        return tempFilePrefix + "*.tmp"
+    }
+    return fmt.Sprintf("%s%d-*.tmp", tempFilePrefix, currentSession.id)
+}
+
+// tempFileSession returns the session that wrote a temporary file, or false
+// if its name does not tell.
+func tempFileSession(name string) (int64, bool) {
+    if !strings.HasPrefix(name, tempFilePrefix) || !strings.HasSuffix(name, ".tmp") {
+        return 0, false
+    }
+    id, _, found := strings.Cut(strings.TrimPrefix(name, tempFilePrefix), "-")
+    if !found {
+        return 0, false
+    }
+    session, err := strconv.ParseInt(id, 10, 64)
+    return session, err == nil
+}
+
+// removeStaleTempFiles deletes the temporary files in dir that sessions
+// which are no longer running left behind.
+func removeStaleTempFiles(dir string, live map[int64]bool) {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return
+    }
+    for _, entry := range entries {
+        session, ok := tempFileSession(entry.Name())
+        if !ok || live[session] || entry.IsDir() {
+            continue
+        }
+        path := filepath.Join(dir, entry.Name())
+        if err := os.Remove(path); err != nil {
+            logger.Printf("Error removing leftover file %s: %v\n", path, err)
+        } else {
+            logger.Printf("Repaired: removed leftover file %s\n", path)
+        }
+    }
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+    "bytes"
     "image"
     _ "image/jpeg"
     _ "image/png"
@@ -12,6 +13,7 @@ import (
     "strings"
     "fmt"
     "regexp"
+    "strconv"
     "encoding/json"
     "github.com/cespare/xxhash"
     "github.com/rwcarlsen/goexif/exif"
@@ -25,12 +27,67 @@ func init() {
 
 type MediaMetadata struct {
     DateTime     time.Time
-    Location     string
+    TZOffset     *int     // minutes east of UTC of DateTime, nil if unknown
+    DateSource   string   // tag or fallback DateTime came from, see dateFromOriginal
+    Location     string   // "lat,long", kept for compatibility
+    Latitude     *float64 // decimal degrees, nil if unknown
+    Longitude    *float64
+    Altitude     *float64 // meters above sea level
     CameraModel  string
     CameraMake   string
     CameraType   string
     FileType     string
     Resolution   string
+    Duration     float64 // seconds, videos only
+
+    // Exposure details of photos, zero if unknown
+    LensModel       string
+    FocalLength     float64 // mm
+    Aperture        float64 // f-number
+    ExposureTime    float64 // seconds
+    ISO             int
+    Flash           string // "fired" or "off"
+    Orientation     int    // EXIF orientation, 1-8
+    ExposureProgram string
+    SerialNumber    string
+    ContentID       string // Apple ContentIdentifier, links a Live Photo's still and video
+
+    // Descriptions and people, stored in the tags table
+    Tags []mediaTag
+
+    // Place names from the offline geocoder
+    Country string
+    Region  string
+    City    string
+}
+
+// Values of media.date_source
+const (
+    dateFromOriginal     = "DateTimeOriginal"  // EXIF time the photo was taken
+    dateFromDigitized    = "DateTimeDigitized" // EXIF time it was digitized, e.g. scanned
+    dateFromModified     = "DateTime"          // EXIF time the file was last changed
+    dateFromCreationDate = "creationdate"      // local time of Apple videos
+    dateFromCreationTime = "creation_time"     // UTC time the video file was created
+    dateFromLocationDate = "location.date"     // time of the GPS fix of Apple videos
+    dateFromFilename     = "filename"
+    dateFromFolder       = "folder"
+    dateFromMtime        = "mtime"
+    dateFromTakeout      = "takeout" // photoTakenTime of a Google Takeout JSON file
+)
+
+// lowConfidenceDateSources can be far from the capture time: edits change
+// DateTime and copies the modification time, and folders are often named
+// after the first day of a trip.
+var lowConfidenceDateSources = []string{dateFromModified, dateFromFolder, dateFromMtime}
+
+// lowConfidenceFilter returns an SQL condition selecting files with a
+// low-confidence date, or with no recorded source.
+func lowConfidenceFilter() (string, []interface{}) {
+    args := make([]interface{}, len(lowConfidenceDateSources))
+    for i, source := range lowConfidenceDateSources {
+        args[i] = source
+    }
+    return "(date_source IS NULL OR date_source IN (?" + strings.Repeat(", ?", len(args)-1) + "))", args
 }
 
 func logMediaMetadata(path string, metadata MediaMetadata ) (error) {
@@ -40,7 +97,16 @@ func logMediaMetadata(path string, metadata MediaMetadata ) (error) {
 
 }
 
-func getMediaMetadata(path string) (MediaMetadata, error) {
+// getMediaMetadata reads the metadata of a file. name is the path the file
+// had at its source, whose file and folder names may give the date.
+func getMediaMetadata(path, name string) (MediaMetadata, error) {
+    return readMediaMetadata(path, name, nil)
+}
+
+// readMediaMetadata is getMediaMetadata for a file whose first bytes are
+// still in memory from writing it. The Exif data is read from head if it
+// is complete there.
+func readMediaMetadata(path, name string, head []byte) (MediaMetadata, error) {
     file, err := os.Open(path)
     if err != nil {
         return MediaMetadata{}, fmt.Errorf("failed to open file: %w", err)
@@ -57,7 +123,13 @@ func getMediaMetadata(path string) (MediaMetadata, error) {
     }
 
     if fileType == "image" || fileType == "image_raw" {
-        x, err := exif.Decode(file)
+        var x *exif.Exif
+        if head != nil {
+            x, err = decodeExif(bytes.NewReader(head), path)
+        }
+        if head == nil || err != nil {
+            x, err = decodeExif(file, path)
+        }
         if err != nil {
             logger.Printf("Warning: Could not read full EXIF data for %s (has some content %t): %v\n", path, x!=nil, err)
             // Even if full EXIF decoding fails, try to read individual fields
@@ -65,12 +137,13 @@ func getMediaMetadata(path string) (MediaMetadata, error) {
         
         if x != nil {
 
-            metadata.DateTime, err = getExifDateTime(x)
+            var zoned bool
+            metadata.DateTime, metadata.DateSource, zoned, err = getExifDateTime(x)
             if err != nil {
                 logger.Printf("Warning: Could not read DateTime from EXIF for %s: %v\n", path, err)
             }
             
-            metadata.Location, err = getExifLocation(x)
+            err = getExifGPS(x, &metadata)
             if err != nil {
                 logger.Printf("Warning: Could not read Location from EXIF for %s: %v\n", path, err)
             }
@@ -86,6 +159,20 @@ func getMediaMetadata(path string) (MediaMetadata, error) {
             }
             
             metadata.CameraType = determineCameraType(metadata.CameraModel, metadata.CameraMake)
+
+            // Without an offset tag the camera's configured time zone applies
+            if !zoned && !metadata.DateTime.IsZero() {
+                if loc := cameraTimeZone(metadata.CameraModel); loc != nil {
+                    metadata.DateTime = withWallClock(metadata.DateTime, loc)
+                    zoned = true
+                }
+            }
+            if zoned {
+                metadata.setTimeZone()
+            }
+
+            getExifExposure(x, &metadata)
+            metadata.ContentID = appleContentIdentifier(x)
         }
 
         // For standard image files, try to get resolution from image 
@@ -119,26 +206,56 @@ func getMediaMetadata(path string) (MediaMetadata, error) {
             metadata.Resolution = "unknown"
         }
 
-        // If DateTime is not set, fall back to file modification time
+        // If DateTime is not set, fall back to the name or modification time
         if metadata.DateTime.IsZero() {
-            metadata.DateTime, err = getModificationTime(file)
-            if err != nil {
-                logger.Printf("Warning: Could not get modification time for %s: %v\n", path, err)
-            }
+            setFallbackDate(path, name, &metadata)
         }
     } else if fileType == "video" {
-        metadata, err = getVideoMetadata(path)
+        metadata, err = getVideoMetadata(path, name)
         if err != nil {
             return MediaMetadata{}, fmt.Errorf("failed to extract video metadata: %w", err)
         }
     }
 
+    lookupPlace(&metadata)
+
   //  logMediaMetadata(path, metadata)
     return metadata, nil
 }
 
 
+// decodeExif reads the Exif data of a JPEG, TIFF, RAW, HEIF or WebP file.
+func decodeExif(r io.Reader, path string) (*exif.Exif, error) {
+    if isContainerImage(path) {
+        img, err := readContainerImage(path)
+        if err != nil {
+            return nil, err
+        }
+        if img.exif == nil {
+            return nil, fmt.Errorf("no Exif data found")
+        }
+        r = bytes.NewReader(img.exif)
+    }
+    x, err := exif.Decode(r)
+    if x != nil && err != nil {
+        // Parsers registered after a failing one are skipped by goexif
+        extraExifParser{}.Parse(x)
+    }
+    return x, err
+}
+
 func getImageResolution(path string) (string, error) {
+    if isContainerImage(path) {
+        img, err := readContainerImage(path)
+        if err != nil {
+            return "", err
+        }
+        if img.width == 0 || img.height == 0 {
+            return "", fmt.Errorf("no image size found")
+        }
+        return fmt.Sprintf("%dx%d", img.width, img.height), nil
+    }
+
     file, err := os.Open(path)
     if err != nil {
         return "", err
@@ -154,33 +271,58 @@ func getImageResolution(path string) (string, error) {
 }
 
 
-func getExifDateTime(x *exif.Exif) (time.Time, error) {
-    for _, tag := range []string{"DateTimeOriginal", "CreateDate", "DateTime", "ModifyDate"} {
-        dt, err := x.Get(exif.FieldName(tag))
+// getExifDateTime returns the capture time, the tag it came from and whether
+// its offset from UTC is known. Times without an offset are returned as UTC.
+func getExifDateTime(x *exif.Exif) (time.Time, string, bool, error) {
+    // Each date tag has its own offset tag since Exif 2.31
+    tags := []struct {
+        date, offset exif.FieldName
+        source       string
+    }{
+        {exif.DateTimeOriginal, OffsetTimeOriginal, dateFromOriginal},
+        {exif.DateTimeDigitized, OffsetTimeDigitized, dateFromDigitized},
+        {exif.DateTime, OffsetTime, dateFromModified},
+    }
+    for _, tag := range tags {
+        dt, err := x.Get(tag.date)
         if err == nil {
             str, err := dt.StringVal()
             if err == nil {
                 t, err := parseExifDate(str)
                 if err == nil {
-                    return t, nil
+                    if offset, err := getExifTag(x, tag.offset); err == nil {
+                        if seconds, err := parseUTCOffset(offset); err == nil {
+                            return withWallClock(t, time.FixedZone("", seconds)), tag.source, true, nil
+                        }
+                    }
+                    return t, tag.source, t.Location() != time.UTC, nil
                 }
             }
         }
     }
     
     // If no valid date is found in any of the tags
-    return time.Time{}, fmt.Errorf("no valid date found in EXIF")
+    return time.Time{}, "", false, fmt.Errorf("no valid date found in EXIF")
 }
 
 
 
 
-func getExifLocation(x *exif.Exif) (string, error) {
+func getExifGPS(x *exif.Exif, metadata *MediaMetadata) error {
     lat, long, err := x.LatLong()
     if err != nil {
-        return "", err
+        return err
+    }
+    var altitude *float64
+    if alt, err := getExifRational(x, exif.GPSAltitude); err == nil {
+        // Reference 1 means below sea level
+        if ref, err := getExifInt(x, exif.GPSAltitudeRef); err == nil && ref == 1 {
+            alt = -alt
+        }
+        altitude = &alt
     }
-    return fmt.Sprintf("%.6f,%.6f", lat, long), nil
+    metadata.setLocation(lat, long, altitude)
+    return nil
 }
 func getExifTag(x *exif.Exif, tag exif.FieldName) (string, error) {
     field, err := x.Get(tag)
@@ -195,6 +337,64 @@ func getExifTag(x *exif.Exif, tag exif.FieldName) (string, error) {
 }
 
 
+// exposurePrograms names the values of the ExposureProgram tag.
+var exposurePrograms = map[int]string{
+    1: "manual",
+    2: "program",
+    3: "aperture_priority",
+    4: "shutter_priority",
+    5: "creative",
+    6: "action",
+    7: "portrait",
+    8: "landscape",
+}
+
+// getExifExposure fills in the lens and exposure fields. Missing tags are
+// common and simply leave the field empty.
+func getExifExposure(x *exif.Exif, metadata *MediaMetadata) {
+    metadata.LensModel, _ = getExifTag(x, exif.LensModel)
+    metadata.FocalLength, _ = getExifRational(x, exif.FocalLength)
+    metadata.Aperture, _ = getExifRational(x, exif.FNumber)
+    metadata.ExposureTime, _ = getExifRational(x, exif.ExposureTime)
+    metadata.ISO, _ = getExifInt(x, exif.ISOSpeedRatings)
+    metadata.Orientation, _ = getExifInt(x, exif.Orientation)
+    if flash, err := getExifInt(x, exif.Flash); err == nil {
+        // Bit 0 tells whether the flash fired
+        metadata.Flash = "off"
+        if flash&1 != 0 {
+            metadata.Flash = "fired"
+        }
+    }
+    if program, err := getExifInt(x, exif.ExposureProgram); err == nil {
+        metadata.ExposureProgram = exposurePrograms[program]
+    }
+    metadata.SerialNumber, _ = getExifTag(x, BodySerialNumber)
+    metadata.SerialNumber = strings.TrimSpace(metadata.SerialNumber)
+}
+
+func getExifRational(x *exif.Exif, tag exif.FieldName) (float64, error) {
+    field, err := x.Get(tag)
+    if err != nil {
+        return 0, err
+    }
+    num, den, err := field.Rat2(0)
+    if err != nil {
+        return 0, err
+    }
+    if den == 0 {
+        return 0, fmt.Errorf("invalid %s", tag)
+    }
+    return float64(num) / float64(den), nil
+}
+
+func getExifInt(x *exif.Exif, tag exif.FieldName) (int, error) {
+    field, err := x.Get(tag)
+    if err != nil {
+        return 0, err
+    }
+    return field.Int(0)
+}
+
 func getExifResolution(x *exif.Exif) (string, error) {
     if x == nil {
         return "", fmt.Errorf("nil EXIF data")
@@ -266,7 +466,7 @@ func determineCameraType(model, make string) string {
 func isMediaFile(path string) (fileType string, isMedia bool) {
     ext := strings.ToLower(filepath.Ext(path))
     switch ext {
-    case ".jpg", ".jpeg", ".png", ".tiff", ".tif":
+    case ".jpg", ".jpeg", ".png", ".tiff", ".tif", ".heic", ".heif", ".hif", ".avif", ".webp":
         return "image", true
     case ".cr2", ".crw", ".cr3", ".dng", ".nef", ".arw", ".x3f", ".orf", ".rw2", ".raf", ".pef", ".srw", ".raw":
         return "image_raw", true
@@ -315,31 +515,35 @@ type FFProbeOutput struct {
         CodecType string `json:"codec_type"`
         Width     int    `json:"width"`
         Height    int    `json:"height"`
-        Tags      struct {
-            CreationTime string `json:"creation_time"`
-        } `json:"tags"`
     } `json:"streams"`
     Format struct {
-        Filename string `json:"filename"`
-        Tags     struct {
-            CreationTime             string `json:"creation_time"`
-            Software                 string `json:"software"`
-            Location                 string `json:"location"`
-            LocationEng              string `json:"location-eng"`
-            AndroidVersion           string `json:"com.android.version"`
-            AndroidCaptureFPS        string `json:"com.android.capture.fps"`
-            AppleQuicktimeMake       string `json:"com.apple.quicktime.make"`
-            AppleQuicktimeModel      string `json:"com.apple.quicktime.model"`
-            AppleQuicktimeLocationDate string `json:"com.apple.quicktime.location.date"`
-            AppleQuicktimeLocationISO6709 string `json:"com.apple.quicktime.location.ISO6709"`
-        } `json:"tags"`
+        Filename string            `json:"filename"`
+        Duration string            `json:"duration"`
+        Tags     map[string]string `json:"tags"`
     } `json:"format"`
 }
-func getVideoMetadata(path string) (MediaMetadata, error) {
-    metadata := MediaMetadata{
-        FileType: "video",
+
+// probeVideo reads MP4 and QuickTime files natively and uses ffprobe, if it
+// is installed, for other containers or files the native reader rejects.
+func probeVideo(path string) (videoProbe, error) {
+    var nativeErr error
+    if isISOBMFF(path) {
+        probe, err := readMP4Metadata(path)
+        if err == nil {
+            return probe, nil
+        }
+        nativeErr = err
     }
+    if _, err := exec.LookPath("ffprobe"); err != nil {
+        if nativeErr != nil {
+            return videoProbe{}, nativeErr
+        }
+        return videoProbe{}, fmt.Errorf("unsupported container and ffprobe is not installed")
+    }
+    return runFFProbe(path)
+}
 
+func runFFProbe(path string) (videoProbe, error) {
     cmd := exec.Command("ffprobe",
         "-v", "quiet",
         "-print_format", "json",
@@ -349,28 +553,61 @@ func getVideoMetadata(path string) (MediaMetadata, error) {
 
     output, err := cmd.Output()
     if err != nil {
-        return metadata, fmt.Errorf("ffprobe failed: %w", err)
+        return videoProbe{}, fmt.Errorf("ffprobe failed: %w", err)
     }
 
     var ffprobeData FFProbeOutput
     if err := json.Unmarshal(output, &ffprobeData); err != nil {
-        return metadata, fmt.Errorf("failed to parse ffprobe output: %w", err)
+        return videoProbe{}, fmt.Errorf("failed to parse ffprobe output: %w", err)
     }
 
-    // Extract resolution
+    probe := videoProbe{tags: ffprobeData.Format.Tags}
+    if probe.tags == nil {
+        probe.tags = make(map[string]string)
+    }
     for _, stream := range ffprobeData.Streams {
         if stream.CodecType == "video" {
-            metadata.Resolution = fmt.Sprintf("%dx%d", stream.Width, stream.Height)
+            probe.width, probe.height = stream.Width, stream.Height
             break
         }
     }
+    probe.duration, _ = strconv.ParseFloat(ffprobeData.Format.Duration, 64)
+    return probe, nil
+}
+
+func getVideoMetadata(path, name string) (MediaMetadata, error) {
+    metadata := MediaMetadata{
+        FileType: "video",
+    }
+
+    probe, err := probeVideo(path)
+    if err != nil {
+        logger.Printf("Warning: Could not read video metadata for %s, using file modification time: %v\n", path, err)
+        probe = videoProbe{tags: map[string]string{}}
+    }
+    tags := probe.tags
+
+    // Extract resolution
+    if probe.width > 0 && probe.height > 0 {
+        metadata.Resolution = fmt.Sprintf("%dx%d", probe.width, probe.height)
+    }
+    metadata.Duration = probe.duration
+
+    // Apple devices record the local time with its offset, prefer that to
+    // the UTC creation time
+    if t, err := time.Parse("2006-01-02T15:04:05-0700", tags["com.apple.quicktime.creationdate"]); err == nil {
+        metadata.DateTime = t
+        metadata.DateSource = dateFromCreationDate
+        metadata.setTimeZone()
+    }
 
     // Extract creation time
-    creationTime := ffprobeData.Format.Tags.CreationTime
+    inUTC := false
+    creationTime, source := tags["creation_time"], dateFromCreationTime
     if creationTime == "" {
-        creationTime = ffprobeData.Format.Tags.AppleQuicktimeLocationDate
+        creationTime, source = tags["com.apple.quicktime.location.date"], dateFromLocationDate
     }
-    if creationTime != "" {
+    if creationTime != "" && metadata.DateTime.IsZero() {
         // Try parsing with multiple formats
         formats := []string{
             "2006-01-02T15:04:05.000000Z",
@@ -382,53 +619,74 @@ func getVideoMetadata(path string) (MediaMetadata, error) {
         for _, format := range formats {
             if t, err := time.Parse(format, creationTime); err == nil {
                 metadata.DateTime = t
+                metadata.DateSource = source
+                metadata.setTimeZone()
+                inUTC = t.Location() == time.UTC
                 break
             }
         }
     }
 
-    // If DateTime is still not set, fall back to file modification time
+    // If DateTime is still not set, fall back to the name or modification time
     if metadata.DateTime.IsZero() {
-        file, err := os.Open(path)
-        if err == nil {
-            metadata.DateTime, _ = getModificationTime(file)
-            file.Close()
-        }
+        setFallbackDate(path, name, &metadata)
     }
 
     // Extract location
-    location := ffprobeData.Format.Tags.Location
+    location := tags["location"]
     if location == "" {
-        location = ffprobeData.Format.Tags.LocationEng
+        location = tags["location-eng"]
     }
     if location == "" {
-        location = ffprobeData.Format.Tags.AppleQuicktimeLocationISO6709
+        location = tags["com.apple.quicktime.location.ISO6709"]
     }
     if location != "" {
-        metadata.Location = strings.TrimSuffix(location, "/")
+        lat, long, altitude, err := parseISO6709(location)
+        if err != nil {
+            logger.Printf("Warning: Could not parse location of %s: %v\n", path, err)
+        } else {
+            metadata.setLocation(lat, long, altitude)
+        }
     }
 
     // Check for camera information
-    if ffprobeData.Format.Tags.AppleQuicktimeMake != "" {
-        metadata.CameraMake = ffprobeData.Format.Tags.AppleQuicktimeMake
-        metadata.CameraModel = ffprobeData.Format.Tags.AppleQuicktimeModel
+    if tags["com.apple.quicktime.make"] != "" {
+        metadata.CameraMake = tags["com.apple.quicktime.make"]
+        metadata.CameraModel = tags["com.apple.quicktime.model"]
         metadata.CameraType = "camera"
-    } else if ffprobeData.Format.Tags.AndroidVersion != "" {
-        metadata.CameraModel = fmt.Sprintf("Android %s", ffprobeData.Format.Tags.AndroidVersion)
+    } else if tags["com.android.version"] != "" {
+        metadata.CameraModel = fmt.Sprintf("Android %s", tags["com.android.version"])
         metadata.CameraMake = "Android"
         metadata.CameraType = "phone"
-        if fps := ffprobeData.Format.Tags.AndroidCaptureFPS; fps != "" {
+        if fps := tags["com.android.capture.fps"]; fps != "" {
             metadata.CameraModel += fmt.Sprintf(" (FPS: %s)", fps)
         }
-    }  else if ffprobeData.Format.Tags.Software != "" {
-        if strings.HasPrefix(ffprobeData.Format.Tags.Software, "Canon") {
+    } else if tags["make"] != "" {
+        metadata.CameraMake = tags["make"]
+        metadata.CameraModel = tags["model"]
+        metadata.CameraType = determineCameraType(metadata.CameraModel, metadata.CameraMake)
+    } else if tags["software"] != "" {
+        if strings.HasPrefix(tags["software"], "Canon") {
             metadata.CameraMake = "Canon"
-            metadata.CameraModel = ffprobeData.Format.Tags.Software
+            metadata.CameraModel = tags["software"]
             metadata.CameraType = "camera"
         } else {
-            metadata.CameraModel = ffprobeData.Format.Tags.Software
+            metadata.CameraModel = tags["software"]
         } 
     }    
+
+    metadata.ContentID = tags["com.apple.quicktime.content.identifier"]
+
+    // Creation times in UTC are shown in the camera's time zone, or else the
+    // local one, so that videos file like photos taken at the same time
+    if inUTC {
+        loc := cameraTimeZone(metadata.CameraModel)
+        if loc == nil {
+            loc = time.Local
+        }
+        metadata.DateTime = metadata.DateTime.In(loc)
+        metadata.setTimeZone()
+    }
     
     return metadata, nil
 }
@@ -0,0 +1,261 @@
+package cmd
+
+import (
+    "database/sql"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// Sidecars are files other programs and devices keep next to a media file:
+// XMP metadata of Lightroom and darktable, THM thumbnails of Canon cameras,
+// AAE edit instructions of Apple devices and the LRV low resolution copies
+// and SRT flight logs of DJI and GoPro cameras. They are named after their
+// media file, either IMG_0001.xmp or IMG_0001.CR2.xmp, and follow it into
+// the library under its new name.
+
+// sidecarOwners decides which of several media files with the same base
+// name, such as the still and video of a Live Photo, gets a sidecar named
+// IMG_0001.xmp: the first file type listed for its extension.
+var sidecarOwners = map[string][]string{
+    ".xmp": {"image_raw", "image", "video"},
+    ".aae": {"image", "image_raw", "video"},
+    ".thm": {"video", "image_raw", "image"},
+    ".lrv": {"video", "image_raw", "image"},
+    ".srt": {"video", "image_raw", "image"},
+}
+
+func isSidecarFile(path string) bool {
+    return sidecarOwners[strings.ToLower(filepath.Ext(path))] != nil
+}
+
+// placedSidecar is a sidecar at its place in the library.
+type placedSidecar struct {
+    source  string
+    path    string
+    hash    uint64
+    renamed bool
+}
+
+// findSidecars returns the sidecars of a media file in its source folder.
+func findSidecars(path string) []string {
+    names, err := listSiblings(filepath.Dir(path))
+    if err != nil {
+        logger.Printf("Warning: Could not look for sidecars of %s: %v\n", path, err)
+        return nil
+    }
+    base := strings.ToLower(filepath.Base(path))
+    stem := pairStem(path)
+    fileType, _ := isMediaFile(path)
+
+    // File types of the media files with the same base name
+    stemTypes := map[string]bool{}
+    for _, name := range names {
+        if otherType, isMedia := isMediaFile(name); isMedia && pairStem(name) == stem {
+            stemTypes[otherType] = true
+        }
+    }
+
+    var sidecars []string
+    for _, name := range names {
+        if !isSidecarFile(name) {
+            continue
+        }
+        owns := strings.HasPrefix(strings.ToLower(name), base+".")
+        if !owns && pairStem(name) == stem {
+            for _, ownerType := range sidecarOwners[strings.ToLower(filepath.Ext(name))] {
+                if stemTypes[ownerType] {
+                    owns = ownerType == fileType
+                    break
+                }
+            }
+        }
+        if owns {
+            sidecars = append(sidecars, filepath.Join(filepath.Dir(path), name))
+        }
+    }
+    return sidecars
+}
+
+// hasSidecarOwner tells whether a sidecar belongs to a media file next to
+// it, which takes it along when it is imported.
+func hasSidecarOwner(path string) bool {
+    names, err := listSiblings(filepath.Dir(path))
+    if err != nil {
+        return false
+    }
+    name := strings.ToLower(filepath.Base(path))
+    owner := strings.TrimSuffix(name, filepath.Ext(name))
+    stem := pairStem(path)
+    for _, sibling := range names {
+        if _, isMedia := isMediaFile(sibling); !isMedia {
+            continue
+        }
+        if strings.ToLower(sibling) == owner || pairStem(sibling) == stem {
+            return true
+        }
+    }
+    return false
+}
+
+// sidecarTarget renames a sidecar of mediaPath for the media file at
+// newMediaPath, e.g. IMG_0001.CR2.xmp to IMG_0001_1.CR2.xmp.
+func sidecarTarget(sidecar, mediaPath, newMediaPath string) string {
+    name := filepath.Base(sidecar)
+    mediaBase := filepath.Base(mediaPath)
+    mediaStem := strings.TrimSuffix(mediaBase, filepath.Ext(mediaBase))
+    newBase := filepath.Base(newMediaPath)
+    newStem := strings.TrimSuffix(newBase, filepath.Ext(newBase))
+    if len(name) > len(mediaStem) && strings.EqualFold(name[:len(mediaStem)], mediaStem) {
+        name = newStem + name[len(mediaStem):]
+    }
+    return filepath.Join(filepath.Dir(newMediaPath), name)
+}
+
+// placeSidecars copies or moves the sidecars of a media file next to its
+// copy in the library. A sidecar that can not be placed is reported but
+// does not fail the import of its media file.
+func placeSidecars(sidecars []string, sourcePath, newPath string) []placedSidecar {
+    var placed []placedSidecar
+    for _, sidecar := range sidecars {
+        target := sidecarTarget(sidecar, sourcePath, newPath)
+        hash, err := computeXXHash(sidecar)
+        if err != nil {
+            logger.Printf("Warning: Could not read sidecar %s: %v\n", sidecar, err)
+            continue
+        }
+        if target == sidecar {
+            placed = append(placed, placedSidecar{source: sidecar, path: target, hash: hash})
+            continue
+        }
+        if existingHash, err := computeXXHash(target); err == nil {
+            // Never overwrite a sidecar that may have been edited since
+            if existingHash != hash {
+                logger.Printf("Warning: Sidecar %s not copied, %s exists with different content\n", sidecar, target)
+                fmt.Printf("\nWarning: sidecar %s not copied, %s exists with different content\n", sidecar, target)
+                continue
+            }
+            placed = append(placed, placedSidecar{source: sidecar, path: target, hash: hash})
+            continue
+        }
+        renamed, err := copyFile(sidecar, target)
+        if err != nil {
+            logger.Printf("Warning: Could not copy sidecar %s to %s: %v\n", sidecar, target, err)
+            fmt.Printf("\nWarning: could not copy sidecar %s: %v\n", sidecar, err)
+            continue
+        }
+        placed = append(placed, placedSidecar{source: sidecar, path: target, hash: hash, renamed: renamed})
+    }
+    return placed
+}
+
+func sidecarPaths(sidecars []placedSidecar) []string {
+    var paths []string
+    for _, sidecar := range sidecars {
+        paths = append(paths, sidecar.path)
+    }
+    return paths
+}
+
+// storeSidecars records the sidecars of the media file with the given hash.
+func storeSidecars(db dbExecer, hash uint64, sidecars []placedSidecar) error {
+    for _, sidecar := range sidecars {
+        kind := strings.TrimPrefix(strings.ToLower(filepath.Ext(sidecar.path)), ".")
+        _, err := db.Exec(`INSERT INTO sidecars (media_id, kind, original_path, path, hash)
+            SELECT id, ?, ?, ?, ? FROM media WHERE hash = ?`,
+            kind, sidecar.source, sidecar.path, int64(sidecar.hash), int64(hash))
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// attachSidecars places the sidecars of a media file that is already in the
+// library next to its library copy and records those that are new. It
+// returns their paths in the library.
+func attachSidecars(db *sql.DB, sourcePath string, hash uint64) []string {
+    sidecars := findSidecars(sourcePath)
+    if len(sidecars) == 0 {
+        return nil
+    }
+    _, existingPath, err := checkDuplicate(db, hash)
+    if err != nil || existingPath == "" {
+        return nil
+    }
+    var mediaID int64
+    if err := db.QueryRow(`SELECT id FROM media WHERE new_path = ?`, existingPath).Scan(&mediaID); err != nil {
+        logger.Printf("Error looking up %s: %v\n", existingPath, err)
+        return nil
+    }
+    var paths []string
+    if dryRun {
+        for _, sidecar := range sidecars {
+            target := sidecarTarget(sidecar, sourcePath, existingPath)
+            if !sidecarRecorded(db, mediaID, target) {
+                paths = append(paths, target)
+            }
+        }
+        return paths
+    }
+    for _, sidecar := range placeSidecars(sidecars, sourcePath, existingPath) {
+        if sidecarRecorded(db, mediaID, sidecar.path) {
+            continue
+        }
+        kind := strings.TrimPrefix(strings.ToLower(filepath.Ext(sidecar.path)), ".")
+        _, err := db.Exec(`INSERT INTO sidecars (media_id, kind, original_path, path, hash) VALUES (?, ?, ?, ?, ?)`,
+            mediaID, kind, sidecar.source, sidecar.path, int64(sidecar.hash))
+        if err != nil {
+            logger.Printf("Error storing sidecar %s: %v\n", sidecar.path, err)
+            continue
+        }
+        logger.Printf("Sidecar added: %s -> %s\n", sidecar.source, sidecar.path)
+        paths = append(paths, sidecar.path)
+    }
+    return paths
+}
+
+func sidecarRecorded(db *sql.DB, mediaID int64, path string) bool {
+    var count int
+    err := db.QueryRow(`SELECT COUNT(*) FROM sidecars WHERE media_id = ? AND path = ?`, mediaID, path).Scan(&count)
+    return err == nil && count > 0
+}
+
+// moveSidecars renames the recorded sidecars of a media file that moved
+// within the library.
+func moveSidecars(db *sql.DB, mediaID int64, path, target string) error {
+    rows, err := db.Query(`SELECT id, path FROM sidecars WHERE media_id = ?`, mediaID)
+    if err != nil {
+        return err
+    }
+    type sidecarRow struct {
+        id   int64
+        path string
+    }
+    var sidecars []sidecarRow
+    for rows.Next() {
+        var s sidecarRow
+        if err := rows.Scan(&s.id, &s.path); err != nil {
+            rows.Close()
+            return err
+        }
+        sidecars = append(sidecars, s)
+    }
+    rows.Close()
+
+    for _, s := range sidecars {
+        newPath := sidecarTarget(s.path, path, target)
+        if _, err := os.Stat(newPath); err == nil {
+            newPath = generateUniqueFilename(newPath)
+        }
+        if err := os.Rename(s.path, newPath); err != nil {
+            fmt.Printf("Warning: could not move %s: %v\n", s.path, err)
+            continue
+        }
+        if _, err := db.Exec(`UPDATE sidecars SET path = ? WHERE id = ?`, newPath, s.id); err != nil {
+            return err
+        }
+    }
+    return nil
+}
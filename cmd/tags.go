@@ -0,0 +1,27 @@
+package cmd
+
+// Tags are free-form labels of a media file, such as the description and
+// the people Google Photos knows of it, kept in the tags table.
+
+// Values of tags.kind
+const (
+    tagDescription = "description"
+    tagPerson      = "person"
+)
+
+type mediaTag struct {
+    Kind  string
+    Value string
+}
+
+// storeTags records the tags of the media file with the given hash.
+func storeTags(db dbExecer, hash uint64, tags []mediaTag) error {
+    for _, tag := range tags {
+        _, err := db.Exec(`INSERT INTO tags (media_id, kind, value) SELECT id, ?, ? FROM media WHERE hash = ?`,
+            tag.Kind, tag.Value, int64(hash))
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,380 @@
+package cmd
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "path"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Google Takeout exports keep what Google Photos knows about a photo in a
+// JSON file next to it, e.g. IMG_0001.jpg.json, while the photo itself often
+// has its EXIF data stripped and the export date as modification time. With
+// --takeout the capture time, position, description and people are taken
+// from the JSON files, also when the export is imported as zip or tgz files.
+
+var takeoutMode bool
+
+// takeoutJSON is the part of a Takeout JSON file that is used.
+type takeoutJSON struct {
+    Title          string `json:"title"`
+    Description    string `json:"description"`
+    PhotoTakenTime struct {
+        Timestamp string `json:"timestamp"` // seconds since 1970, UTC
+    } `json:"photoTakenTime"`
+    GeoData     takeoutGeoData `json:"geoData"`
+    GeoDataExif takeoutGeoData `json:"geoDataExif"`
+    People      []struct {
+        Name string `json:"name"`
+    } `json:"people"`
+}
+
+// takeoutGeoData is a position, all zero if unknown.
+type takeoutGeoData struct {
+    Latitude  float64 `json:"latitude"`
+    Longitude float64 `json:"longitude"`
+    Altitude  float64 `json:"altitude"`
+}
+
+// Takeout shortens the name of a JSON file to this many characters before
+// ".json", so IMG_20190101_123456_with_a_long_description.jpg gets
+// IMG_20190101_123456_with_a_long_descriptio.json.
+const takeoutMaxNameLength = 46
+
+var (
+    // Duplicate names are numbered as IMG_0001(1).jpg, whose JSON file is
+    // IMG_0001.jpg(1).json
+    takeoutCounterPattern = regexp.MustCompile(`^(.*)(\(\d+\))(\.[^.]*)$`)
+    // Copies edited in Google Photos share the JSON file of the original
+    takeoutEditedSuffixes = []string{"-edited", "-bearbeitet", "-modifié", "-editado", "-modificato", "-bewerkt"}
+)
+
+func isTakeoutJSON(name string) bool {
+    return strings.EqualFold(filepath.Ext(name), ".json")
+}
+
+// takeoutFolder holds the JSON files of one folder of an export.
+type takeoutFolder struct {
+    byName  map[string]*takeoutJSON // lower case file name
+    byTitle map[string]*takeoutJSON // lower case original name of the media file
+    byStem  map[string]*takeoutJSON // same without its extension
+}
+
+func newTakeoutFolder() *takeoutFolder {
+    return &takeoutFolder{
+        byName:  map[string]*takeoutJSON{},
+        byTitle: map[string]*takeoutJSON{},
+        byStem:  map[string]*takeoutJSON{},
+    }
+}
+
+func (f *takeoutFolder) add(name string, data []byte) {
+    var info takeoutJSON
+    if err := json.Unmarshal(data, &info); err != nil {
+        logger.Printf("Warning: Could not parse Takeout JSON file %s: %v\n", name, err)
+        return
+    }
+    // Albums have a metadata.json without a capture time
+    if info.Title == "" || info.PhotoTakenTime.Timestamp == "" {
+        return
+    }
+    f.byName[strings.ToLower(path.Base(name))] = &info
+    title := strings.ToLower(info.Title)
+    if _, ok := f.byTitle[title]; !ok {
+        f.byTitle[title] = &info
+    }
+    stem := strings.TrimSuffix(title, path.Ext(title))
+    if _, ok := f.byStem[stem]; !ok {
+        f.byStem[stem] = &info
+    }
+}
+
+// find returns the JSON file of a media file. Videos of Live Photos and
+// motion photos have none of their own and get the one of their still.
+func (f *takeoutFolder) find(name string) *takeoutJSON {
+    for _, candidate := range takeoutJSONNames(name) {
+        if info, ok := f.byName[strings.ToLower(candidate)]; ok {
+            return info
+        }
+    }
+    lower := strings.ToLower(name)
+    if info, ok := f.byTitle[lower]; ok {
+        return info
+    }
+    return f.byStem[strings.TrimSuffix(lower, path.Ext(lower))]
+}
+
+// takeoutJSONNames returns the names the JSON file of a media file may
+// have, best match first.
+func takeoutJSONNames(name string) []string {
+    base, counter := name, ""
+    if match := takeoutCounterPattern.FindStringSubmatch(name); match != nil {
+        base, counter = match[1]+match[3], match[2]
+    }
+    ext := path.Ext(base)
+    stem := strings.TrimSuffix(base, ext)
+    for _, suffix := range takeoutEditedSuffixes {
+        if strings.HasSuffix(strings.ToLower(stem), suffix) {
+            stem = stem[:len(stem)-len(suffix)]
+            base = stem + ext
+            break
+        }
+    }
+    // Newer exports name them IMG_0001.jpg.supplemental-metadata.json, and
+    // some leave out the extension of the media file
+    var names []string
+    for _, prefix := range []string{base, base + ".supplemental-metadata", stem} {
+        names = append(names, shortenTakeoutName(prefix)+counter+".json")
+    }
+    return names
+}
+
+func shortenTakeoutName(name string) string {
+    runes := []rune(name)
+    if len(runes) > takeoutMaxNameLength {
+        return string(runes[:takeoutMaxNameLength])
+    }
+    return name
+}
+
+// The JSON files of folders on disk are read when the first media file of
+// the folder is imported. Those in archives are keyed by their folder within
+// the archive, so that the JSON file of a photo can be in another part of a
+// split export. The directory of a zip or 7z file lists its JSON files, so
+// they are read before the import. Tar files can only be read front to
+// back, so their JSON files are read during the import, and the media files
+// before them wait for them, see importPipeline.
+var (
+    takeoutMu             sync.Mutex
+    takeoutFolders        = map[string]*takeoutFolder{}
+    takeoutArchiveFolders = map[string]*takeoutFolder{}
+)
+
+// loadTakeoutFolder must be called with takeoutMu held.
+func loadTakeoutFolder(dir string) *takeoutFolder {
+    if folder, ok := takeoutFolders[dir]; ok {
+        return folder
+    }
+    folder := newTakeoutFolder()
+    takeoutFolders[dir] = folder
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        logger.Printf("Warning: Could not look for Takeout JSON files in %s: %v\n", dir, err)
+        return folder
+    }
+    for _, entry := range entries {
+        if entry.IsDir() || !isTakeoutJSON(entry.Name()) {
+            continue
+        }
+        data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+        if err != nil {
+            logger.Printf("Warning: Could not read Takeout JSON file %s: %v\n", entry.Name(), err)
+            continue
+        }
+        folder.add(entry.Name(), data)
+    }
+    return folder
+}
+
+// takeoutScanned tells whether the JSON files of an archive are read before
+// the import. Archives inside archives are only read once.
+func takeoutScanned(path string, depth int) bool {
+    kind := archiveKind(path)
+    return depth == 0 && (kind == archiveZip || kind == archive7z)
+}
+
+// scanTakeoutArchives reads the JSON files of the zip and 7z archives in
+// sourceDir.
+func scanTakeoutArchives(sourceDir string) {
+    filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+        if err != nil || info.IsDir() || !takeoutScanned(path, 0) {
+            return nil
+        }
+        if err := scanTakeoutArchive(path); err != nil {
+            logger.Printf("Warning: Could not read Takeout JSON files from %s: %v\n", path, err)
+            fmt.Printf("Warning: could not read Takeout JSON files from %s: %v\n", path, err)
+        }
+        return nil
+    })
+}
+
+func scanTakeoutArchive(archivePath string) error {
+    reader, err := openArchive(archivePath)
+    if err != nil {
+        return err
+    }
+    defer reader.Close()
+    for {
+        file, err := reader.next()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if !file.info.Mode().IsRegular() || !isTakeoutJSON(file.name) {
+            continue
+        }
+        if err := readTakeoutMember(file); err != nil {
+            return err
+        }
+    }
+}
+
+// readTakeoutMember reads a JSON file in an archive.
+func readTakeoutMember(file archiveMember) error {
+    member, err := file.open()
+    if err != nil {
+        return err
+    }
+    data, err := io.ReadAll(member)
+    member.Close()
+    if err != nil {
+        return err
+    }
+    dir := path.Dir(file.name)
+    takeoutMu.Lock()
+    defer takeoutMu.Unlock()
+    folder, ok := takeoutArchiveFolders[dir]
+    if !ok {
+        folder = newTakeoutFolder()
+        takeoutArchiveFolders[dir] = folder
+    }
+    folder.add(file.name, data)
+    return nil
+}
+
+// findTakeoutJSON returns the JSON file of the media file at sourcePath,
+// which was imported as key.
+func findTakeoutJSON(sourcePath, key string) *takeoutJSON {
+    takeoutMu.Lock()
+    defer takeoutMu.Unlock()
+    if i := strings.LastIndex(key, "!/"); i >= 0 {
+        name := key[i+2:]
+        folder, ok := takeoutArchiveFolders[path.Dir(name)]
+        if !ok {
+            return nil
+        }
+        return folder.find(path.Base(name))
+    }
+    return loadTakeoutFolder(filepath.Dir(sourcePath)).find(filepath.Base(sourcePath))
+}
+
+// takeoutOverrides tells whether the capture time in a Takeout JSON file is
+// better than the date found for the media file, which is the case unless
+// the camera recorded it.
+func takeoutOverrides(source string) bool {
+    switch source {
+    case dateFromOriginal, dateFromDigitized, dateFromCreationDate, dateFromCreationTime, dateFromLocationDate:
+        return false
+    }
+    return true
+}
+
+// applyTakeoutMetadata adds what the JSON file of a media file knows to its
+// metadata. It returns false if the JSON file was not found.
+func applyTakeoutMetadata(sourcePath, key string, metadata *MediaMetadata) bool {
+    info := findTakeoutJSON(sourcePath, key)
+    if info == nil {
+        return false
+    }
+    if takeoutOverrides(metadata.DateSource) {
+        if seconds, err := strconv.ParseInt(info.PhotoTakenTime.Timestamp, 10, 64); err == nil && seconds > 0 {
+            // Like video creation times, shown in the camera's time zone or
+            // else the local one
+            loc := cameraTimeZone(metadata.CameraModel)
+            if loc == nil {
+                loc = time.Local
+            }
+            metadata.DateTime = time.Unix(seconds, 0).In(loc)
+            metadata.DateSource = dateFromTakeout
+            metadata.setTimeZone()
+        }
+    }
+    if metadata.Latitude == nil {
+        geo := info.GeoData
+        if geo.Latitude == 0 && geo.Longitude == 0 {
+            geo = info.GeoDataExif
+        }
+        if geo.Latitude != 0 || geo.Longitude != 0 {
+            var altitude *float64
+            if geo.Altitude != 0 {
+                altitude = &geo.Altitude
+            }
+            metadata.setLocation(geo.Latitude, geo.Longitude, altitude)
+            lookupPlace(metadata)
+        }
+    }
+    if description := strings.TrimSpace(info.Description); description != "" {
+        metadata.Tags = append(metadata.Tags, mediaTag{Kind: tagDescription, Value: description})
+    }
+    for _, person := range info.People {
+        if name := strings.TrimSpace(person.Name); name != "" {
+            metadata.Tags = append(metadata.Tags, mediaTag{Kind: tagPerson, Value: name})
+        }
+    }
+    return true
+}
+
+// takeoutLate is an archive member that was imported before its JSON file
+// was read.
+type takeoutLate struct {
+    hash     uint64
+    key      string
+    metadata MediaMetadata
+}
+
+// applyLateTakeout adds the metadata of JSON files that were read after
+// their media file was imported, which happens when a split export has them
+// in a later tar file. Files whose date changes are moved like timeshift
+// does. It returns the number of files updated.
+func applyLateTakeout(db *sql.DB, destDir string, files []takeoutLate) int {
+    updated := 0
+    for _, file := range files {
+        metadata := file.metadata
+        if !applyTakeoutMetadata("", file.key, &metadata) {
+            continue
+        }
+        var id int64
+        var path string
+        err := db.QueryRow(`SELECT id, new_path FROM media WHERE hash = ?`, int64(file.hash)).Scan(&id, &path)
+        if err != nil {
+            logger.Printf("Error looking up %s: %v\n", file.key, err)
+            continue
+        }
+        target := generateNewPath(file.key, metadata, file.hash, destDir)
+        if target != path {
+            if _, err := os.Stat(target); err == nil {
+                target = generateUniqueFilename(target)
+            }
+            if err := moveLibraryFile(db, id, path, target); err != nil {
+                logger.Printf("Error moving %s to %s: %v\n", path, target, err)
+                fmt.Printf("Error moving %s to %s: %v\n", path, target, err)
+                target = path
+            }
+        }
+        err = updateMediaRecord(db, int(id), metadata)
+        if err == nil {
+            _, err = db.Exec(`UPDATE media SET new_path = ? WHERE id = ?`, target, id)
+        }
+        if err == nil {
+            err = storeTags(db, file.hash, metadata.Tags)
+        }
+        if err != nil {
+            logger.Printf("Error storing Takeout metadata of %s: %v\n", target, err)
+            fmt.Printf("Error storing Takeout metadata of %s: %v\n", target, err)
+            continue
+        }
+        logger.Printf("Takeout metadata added: %s -> %s\n", file.key, target)
+        updated++
+    }
+    return updated
+}
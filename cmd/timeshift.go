@@ -0,0 +1,567 @@
+package cmd
+
+import (
+    "database/sql"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "github.com/spf13/cobra"
+)
+
+var timeshiftCmd = &cobra.Command{
+    Use:   "timeshift [archive_directory]",
+    Short: "Correct the capture times of files from a camera with a wrong clock",
+    Long: `Shift the capture time of selected files by a fixed offset, e.g. for a camera
+whose clock was not set to the local time of a trip.
+
+Select the files by camera (--model, --serial), capture time (--from, --to)
+and/or import session (--session). Give the correction with --offset, or let
+it be computed from a photo of the wrong camera (--align-from) and a photo of
+the same moment from a device with a correct clock, or the correct time
+(--align-to).
+
+Each run is recorded so it can be reverted with --undo; --list shows the
+recorded runs.`,
+    Args:        cobra.ExactArgs(1),
+    Annotations: map[string]string{libraryArgAnnotation: "0"},
+    Run: func(cmd *cobra.Command, args []string) {
+        destDir := args[0]
+        timeshiftLibrary(destDir)
+    },
+}
+
+var (
+    shiftModel     string
+    shiftSerial    string
+    shiftFrom      string
+    shiftTo        string
+    shiftSession   int64
+    shiftOffset    string
+    alignFrom      string
+    alignTo        string
+    shiftMoveFiles bool
+    shiftWriteXMP  bool
+    shiftWriteExif bool
+    undoShift      int64
+    listShifts     bool
+)
+
+func init() {
+    rootCmd.AddCommand(timeshiftCmd)
+    timeshiftCmd.Flags().StringVar(&shiftModel, "model", "", "Only files from this camera model")
+    timeshiftCmd.Flags().StringVar(&shiftSerial, "serial", "", "Only files from the camera body with this serial number")
+    timeshiftCmd.Flags().StringVar(&shiftFrom, "from", "", "Only files taken at or after this time, e.g. 2024-05-01 or \"2024-05-01 14:00\"")
+    timeshiftCmd.Flags().StringVar(&shiftTo, "to", "", "Only files taken at or before this time; a date includes the whole day")
+    timeshiftCmd.Flags().Int64Var(&shiftSession, "session", 0, "Only files imported in this import session")
+    timeshiftCmd.Flags().StringVar(&shiftOffset, "offset", "", "Time to add, e.g. +1h30m, -2h or +1d")
+    timeshiftCmd.Flags().StringVar(&alignFrom, "align-from", "", "Library file from the camera with the wrong clock")
+    timeshiftCmd.Flags().StringVar(&alignTo, "align-to", "", "Library file taken at the same moment by a correct clock, or the correct time of --align-from")
+    timeshiftCmd.Flags().BoolVar(&shiftMoveFiles, "move-files", false, "Move the files to the place the layout gives for their new time")
+    timeshiftCmd.Flags().StringVar(&layoutTemplate, "layout", defaultLayout, "Layout used with --move-files, as for import")
+    timeshiftCmd.Flags().BoolVar(&shiftWriteXMP, "write-xmp", false, "Write the new times to XMP sidecar files")
+    timeshiftCmd.Flags().BoolVar(&shiftWriteExif, "write-exif", false, "Rewrite the EXIF dates in the library copies of JPEG and TIFF based RAW files")
+    timeshiftCmd.Flags().Int64Var(&undoShift, "undo", 0, "Revert the recorded run with this id")
+    timeshiftCmd.Flags().BoolVar(&listShifts, "list", false, "List the recorded runs")
+    timeshiftCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "Show the changes without making them")
+}
+
+// shiftTarget is a file to shift, with the fields the layout can use.
+type shiftTarget struct {
+    id           int64
+    hash         uint64
+    newPath      string
+    originalPath string
+    zoned        bool
+    metadata     MediaMetadata
+}
+
+func timeshiftLibrary(destDir string) {
+    db, err := initDB(destDir)
+    if err != nil {
+        fmt.Printf("Error opening database: %v\n", err)
+        return
+    }
+    defer db.Close()
+
+    switch {
+    case listShifts:
+        listTimeshifts(db)
+        return
+    case undoShift != 0:
+        undoTimeshift(db, undoShift)
+        return
+    }
+
+    offset, err := shiftAmount(db)
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    where, whereArgs, selection, err := shiftSelection()
+    if err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    var layout *pathLayout
+    if shiftMoveFiles {
+        if layout, err = parseLayout(layoutTemplate); err != nil {
+            fmt.Printf("Error in layout: %v\n", err)
+            return
+        }
+    }
+
+    targets, err := loadShiftTargets(db, where, whereArgs)
+    if err != nil {
+        fmt.Printf("Error querying database: %v\n", err)
+        return
+    }
+    if len(targets) == 0 {
+        fmt.Println("No files match the selection.")
+        return
+    }
+
+    var shiftID int64
+    if dryRun {
+        plannedPaths = make(map[string]bool)
+    } else {
+        res, err := db.Exec(`INSERT INTO timeshifts (created_at, offset_seconds, selection) VALUES (?, ?, ?)`,
+            time.Now(), int64(offset/time.Second), selection)
+        if err == nil {
+            shiftID, err = res.LastInsertId()
+        }
+        if err != nil {
+            fmt.Printf("Error recording time shift: %v\n", err)
+            return
+        }
+    }
+
+    var shifted, errors int
+    for _, t := range targets {
+        if err := shiftMedia(db, shiftID, t, offset, destDir, layout); err != nil {
+            fmt.Printf("Error shifting %s: %v\n", t.newPath, err)
+            errors++
+            continue
+        }
+        shifted++
+    }
+
+    if dryRun {
+        fmt.Printf("Dry run complete. Would shift: %d files by %s, Errors: %d\n", shifted, formatShift(offset), errors)
+        return
+    }
+    fmt.Printf("Time shift %d complete. Shifted: %d files by %s, Errors: %d\n", shiftID, shifted, formatShift(offset), errors)
+    fmt.Printf("Undo with: picmover timeshift --undo %d %s\n", shiftID, destDir)
+}
+
+// shiftAmount returns the time to add, from --offset or the alignment pair.
+func shiftAmount(db *sql.DB) (time.Duration, error) {
+    if shiftOffset != "" {
+        if alignFrom != "" || alignTo != "" {
+            return 0, fmt.Errorf("--offset cannot be combined with --align-from and --align-to")
+        }
+        return parseShiftOffset(shiftOffset)
+    }
+    if alignFrom == "" || alignTo == "" {
+        return 0, fmt.Errorf("give the correction with --offset, or with --align-from and --align-to")
+    }
+    from, err := findMediaTime(db, alignFrom)
+    if err != nil {
+        return 0, err
+    }
+    to, err := findMediaTime(db, alignTo)
+    if err != nil {
+        // Not a library file, try a time
+        var parseErr error
+        to, parseErr = parseShiftTime(alignTo, time.UTC)
+        if parseErr != nil {
+            return 0, fmt.Errorf("--align-to %q is neither a library file nor a time", alignTo)
+        }
+    }
+    // The wrong camera may not know its offset from UTC, so the local wall
+    // clock times are compared
+    return withWallClock(to, time.UTC).Sub(withWallClock(from, time.UTC)), nil
+}
+
+// parseShiftOffset parses a signed duration such as +1h30m, -2h or +1d.
+func parseShiftOffset(s string) (time.Duration, error) {
+    sign := time.Duration(1)
+    unsigned := strings.TrimPrefix(s, "+")
+    if strings.HasPrefix(s, "-") {
+        sign = -1
+        unsigned = s[1:]
+    }
+    d, err := parseAge(unsigned)
+    if err != nil {
+        return 0, err
+    }
+    return sign * d, nil
+}
+
+func formatShift(d time.Duration) string {
+    if d < 0 {
+        return "-" + (-d).String()
+    }
+    return "+" + d.String()
+}
+
+// parseShiftTime parses a date or a date and time given on the command line.
+func parseShiftTime(s string, loc *time.Location) (time.Time, error) {
+    for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"} {
+        if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+            return t, nil
+        }
+    }
+    return time.Time{}, fmt.Errorf("invalid time %q, expected e.g. 2024-05-01 or \"2024-05-01 14:00\"", s)
+}
+
+// findMediaTime returns the capture time of a library file.
+func findMediaTime(db *sql.DB, path string) (time.Time, error) {
+    rows, err := db.Query(`SELECT new_path, date_taken FROM media WHERE status != ?`, mediaMissing)
+    if err != nil {
+        return time.Time{}, err
+    }
+    defer rows.Close()
+
+    wanted := absPath(path)
+    for rows.Next() {
+        var newPath string
+        var dateTaken time.Time
+        if err := rows.Scan(&newPath, &dateTaken); err != nil {
+            return time.Time{}, err
+        }
+        if absPath(newPath) == wanted {
+            return dateTaken, nil
+        }
+    }
+    if err := rows.Err(); err != nil {
+        return time.Time{}, err
+    }
+    return time.Time{}, fmt.Errorf("%s is not in the library", path)
+}
+
+// shiftSelection builds the WHERE clause for the selection options, and a
+// description of it for the record.
+func shiftSelection() (string, []interface{}, string, error) {
+    conditions := []string{"status = ?"}
+    args := []interface{}{mediaOK}
+    var description []string
+    if shiftModel != "" {
+        conditions = append(conditions, "camera_model = ? COLLATE NOCASE")
+        args = append(args, shiftModel)
+        description = append(description, "model="+shiftModel)
+    }
+    if shiftSerial != "" {
+        conditions = append(conditions, "serial_number = ?")
+        args = append(args, shiftSerial)
+        description = append(description, "serial="+shiftSerial)
+    }
+    // Capture times are compared by their local wall clock time, which is
+    // how date_taken starts
+    if shiftFrom != "" {
+        from, err := parseShiftTime(shiftFrom, time.UTC)
+        if err != nil {
+            return "", nil, "", err
+        }
+        conditions = append(conditions, "substr(date_taken, 1, 19) >= ?")
+        args = append(args, from.Format("2006-01-02 15:04:05"))
+        description = append(description, "from="+shiftFrom)
+    }
+    if shiftTo != "" {
+        to, err := parseShiftTime(shiftTo, time.UTC)
+        if err != nil {
+            return "", nil, "", err
+        }
+        if len(shiftTo) == len("2006-01-02") {
+            to = to.AddDate(0, 0, 1)
+        } else {
+            to = to.Add(time.Second)
+        }
+        conditions = append(conditions, "substr(date_taken, 1, 19) < ?")
+        args = append(args, to.Format("2006-01-02 15:04:05"))
+        description = append(description, "to="+shiftTo)
+    }
+    if shiftSession != 0 {
+        // Files changed by an earlier --write-exif are found by their
+        // original hash
+        conditions = append(conditions, `(hash IN (SELECT hash FROM import_journal WHERE session_id = ?)
+            OR id IN (SELECT l.media_id FROM timeshift_log l JOIN import_journal j ON j.hash = l.old_hash WHERE j.session_id = ?))`)
+        args = append(args, shiftSession, shiftSession)
+        description = append(description, fmt.Sprintf("session=%d", shiftSession))
+    }
+    if len(description) == 0 {
+        return "", nil, "", fmt.Errorf("select the files with --model, --serial, --from, --to or --session")
+    }
+    return strings.Join(conditions, " AND "), args, strings.Join(description, " "), nil
+}
+
+func loadShiftTargets(db *sql.DB, where string, args []interface{}) ([]shiftTarget, error) {
+    rows, err := db.Query(`SELECT id, hash, new_path, original_path, date_taken, tz_offset IS NOT NULL,
+        file_type, camera_model, camera_make, camera_type, resolution,
+        COALESCE(country, ''), COALESCE(region, ''), COALESCE(city, '')
+        FROM media WHERE `+where+` ORDER BY date_taken`, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var targets []shiftTarget
+    for rows.Next() {
+        var t shiftTarget
+        var hash int64
+        m := &t.metadata
+        err := rows.Scan(&t.id, &hash, &t.newPath, &t.originalPath, &m.DateTime, &t.zoned,
+            &m.FileType, &m.CameraModel, &m.CameraMake, &m.CameraType, &m.Resolution,
+            &m.Country, &m.Region, &m.City)
+        if err != nil {
+            return nil, err
+        }
+        t.hash = uint64(hash)
+        targets = append(targets, t)
+    }
+    return targets, rows.Err()
+}
+
+// shiftMedia shifts one file and records how to undo it.
+func shiftMedia(db *sql.DB, shiftID int64, t shiftTarget, offset time.Duration, destDir string, layout *pathLayout) error {
+    oldDate := t.metadata.DateTime
+    newDate := oldDate.Add(offset)
+    path, hash := t.newPath, t.hash
+
+    target := path
+    if layout != nil {
+        metadata := t.metadata
+        metadata.DateTime = newDate
+        target = filepath.Join(destDir, layout.expand(layoutFile{sourcePath: t.originalPath, metadata: metadata, hash: hash}))
+        if target != path {
+            if _, err := os.Stat(target); err == nil || plannedPaths[target] {
+                target = generateUniqueFilename(target)
+            }
+        }
+    }
+    writeExif := shiftWriteExif && t.metadata.FileType != "video"
+
+    if dryRun {
+        fmt.Printf("Would shift %s: %s -> %s\n", path, oldDate.Format("2006-01-02 15:04:05"), newDate.Format("2006-01-02 15:04:05"))
+        if target != path {
+            fmt.Printf("  move to %s\n", target)
+            plannedPaths[target] = true
+        }
+        return nil
+    }
+
+    if writeExif {
+        newHash, err := shiftExifDates(path, offset)
+        if err != nil {
+            // The database is still corrected, the EXIF dates are not
+            fmt.Printf("Warning: EXIF dates of %s not changed: %v\n", path, err)
+            writeExif = false
+        } else {
+            hash = newHash
+        }
+    }
+    if target != path {
+        if err := moveLibraryFile(db, t.id, path, target); err != nil {
+            return err
+        }
+        path = target
+    }
+    if shiftWriteXMP {
+        if err := writeXMPSidecar(path, xmpDateProperties(newDate, t.zoned)); err != nil {
+            fmt.Printf("Warning: could not write XMP sidecar for %s: %v\n", path, err)
+        }
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec(`UPDATE media SET date_taken = ?, new_path = ?, hash = ? WHERE id = ?`, newDate, path, int64(hash), t.id)
+    if err == nil {
+        _, err = tx.Exec(`INSERT INTO timeshift_log (shift_id, media_id, old_date, new_date, old_path, new_path, old_hash, new_hash, exif_written, xmp_written)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+            shiftID, t.id, oldDate, newDate, t.newPath, path, int64(t.hash), int64(hash), writeExif, shiftWriteXMP)
+    }
+    if err == nil {
+        err = tx.Commit()
+    } else {
+        tx.Rollback()
+    }
+    if err != nil {
+        return fmt.Errorf("error updating database: %w", err)
+    }
+    fmt.Printf("Shifted %s: %s -> %s\n", path, oldDate.Format("2006-01-02 15:04:05"), newDate.Format("2006-01-02 15:04:05"))
+    return nil
+}
+
+// moveLibraryFile renames a file within the library, taking its sidecars
+// and the XMP sidecar written by picmover along.
+func moveLibraryFile(db *sql.DB, mediaID int64, path, target string) error {
+    if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+        return err
+    }
+    if err := os.Rename(path, target); err != nil {
+        return err
+    }
+    if err := moveSidecars(db, mediaID, path, target); err != nil {
+        fmt.Printf("Warning: could not move the sidecars of %s: %v\n", path, err)
+    }
+    sidecar := xmpSidecarPath(path)
+    if _, err := os.Stat(sidecar); err == nil {
+        if err := os.Rename(sidecar, xmpSidecarPath(target)); err != nil {
+            fmt.Printf("Warning: could not move %s: %v\n", sidecar, err)
+        }
+    }
+    return nil
+}
+
+func listTimeshifts(db *sql.DB) {
+    rows, err := db.Query(`
+        SELECT t.id, t.created_at, t.offset_seconds, t.selection, t.undone_at IS NOT NULL, COUNT(l.media_id)
+        FROM timeshifts t
+        LEFT JOIN timeshift_log l ON l.shift_id = t.id
+        GROUP BY t.id
+        ORDER BY t.id DESC
+    `)
+    if err != nil {
+        fmt.Printf("Error querying time shifts: %v\n", err)
+        return
+    }
+    defer rows.Close()
+
+    fmt.Println("Time Shifts:")
+    fmt.Println("ID | Created | Offset | Files | Undone | Selection")
+    fmt.Println("-------------------------------------------------------------------------------------------------------------------")
+    for rows.Next() {
+        var id, seconds, files int64
+        var createdAt, selection string
+        var undone bool
+        if err := rows.Scan(&id, &createdAt, &seconds, &selection, &undone, &files); err != nil {
+            fmt.Printf("Error scanning row: %v\n", err)
+            continue
+        }
+        fmt.Printf("%d | %s | %s | %d | %t | %s\n", id, createdAt, formatShift(time.Duration(seconds)*time.Second), files, undone, selection)
+    }
+}
+
+// undoTimeshift restores the times, paths and file contents recorded for a
+// run. Files changed again since then are left alone.
+func undoTimeshift(db *sql.DB, id int64) {
+    var seconds int64
+    var undone bool
+    err := db.QueryRow(`SELECT offset_seconds, undone_at IS NOT NULL FROM timeshifts WHERE id = ?`, id).Scan(&seconds, &undone)
+    if err == sql.ErrNoRows {
+        fmt.Printf("Error: there is no time shift %d\n", id)
+        return
+    }
+    if err != nil {
+        fmt.Printf("Error querying database: %v\n", err)
+        return
+    }
+    if undone {
+        fmt.Printf("Error: time shift %d has already been undone\n", id)
+        return
+    }
+    offset := time.Duration(seconds) * time.Second
+
+    type logEntry struct {
+        mediaID          int64
+        oldDate          time.Time
+        oldPath, newPath string
+        oldHash, newHash int64
+        exifWritten      bool
+        xmpWritten       bool
+        currentPath      sql.NullString
+        currentHash      sql.NullInt64
+        zoned            bool
+    }
+    rows, err := db.Query(`SELECT l.media_id, l.old_date, l.old_path, l.new_path, l.old_hash, l.new_hash, l.exif_written, l.xmp_written,
+        m.new_path, m.hash, m.tz_offset IS NOT NULL
+        FROM timeshift_log l LEFT JOIN media m ON m.id = l.media_id
+        WHERE l.shift_id = ?`, id)
+    if err != nil {
+        fmt.Printf("Error querying database: %v\n", err)
+        return
+    }
+    var entries []logEntry
+    for rows.Next() {
+        var e logEntry
+        var zoned sql.NullBool
+        err := rows.Scan(&e.mediaID, &e.oldDate, &e.oldPath, &e.newPath, &e.oldHash, &e.newHash, &e.exifWritten, &e.xmpWritten,
+            &e.currentPath, &e.currentHash, &zoned)
+        if err != nil {
+            fmt.Printf("Error scanning row: %v\n", err)
+            continue
+        }
+        e.zoned = zoned.Bool
+        entries = append(entries, e)
+    }
+    rows.Close()
+
+    var restored, skipped, errors int
+    for _, e := range entries {
+        if !e.currentPath.Valid || e.currentPath.String != e.newPath || e.currentHash.Int64 != e.newHash {
+            fmt.Printf("Skipped %s: changed since the time shift\n", e.newPath)
+            skipped++
+            continue
+        }
+        if dryRun {
+            fmt.Printf("Would restore %s to %s\n", e.newPath, e.oldDate.Format("2006-01-02 15:04:05"))
+            if e.oldPath != e.newPath {
+                fmt.Printf("  move to %s\n", e.oldPath)
+            }
+            restored++
+            continue
+        }
+
+        path, hash := e.newPath, e.newHash
+        if e.exifWritten {
+            newHash, err := shiftExifDates(path, -offset)
+            if err != nil {
+                fmt.Printf("Error restoring EXIF dates of %s: %v\n", path, err)
+                errors++
+                continue
+            }
+            hash = int64(newHash)
+        }
+        if e.oldPath != path {
+            target := e.oldPath
+            if _, err := os.Stat(target); err == nil {
+                target = generateUniqueFilename(target)
+            }
+            if err := moveLibraryFile(db, e.mediaID, path, target); err != nil {
+                fmt.Printf("Error moving %s back: %v\n", path, err)
+                errors++
+                continue
+            }
+            path = target
+        }
+        if e.xmpWritten {
+            if err := writeXMPSidecar(path, xmpDateProperties(e.oldDate, e.zoned)); err != nil {
+                fmt.Printf("Warning: could not write XMP sidecar for %s: %v\n", path, err)
+            }
+        }
+        _, err := db.Exec(`UPDATE media SET date_taken = ?, new_path = ?, hash = ? WHERE id = ?`, e.oldDate, path, hash, e.mediaID)
+        if err != nil {
+            fmt.Printf("Error updating record for %s: %v\n", path, err)
+            errors++
+            continue
+        }
+        fmt.Printf("Restored %s to %s\n", path, e.oldDate.Format("2006-01-02 15:04:05"))
+        restored++
+    }
+
+    if dryRun {
+        fmt.Printf("Dry run complete. Would restore: %d, Skipped: %d, Errors: %d\n", restored, skipped, errors)
+        return
+    }
+    // After errors the run stays open, so the undo can be repeated
+    if errors == 0 {
+        if _, err := db.Exec(`UPDATE timeshifts SET undone_at = ? WHERE id = ?`, time.Now(), id); err != nil {
+            fmt.Printf("Error updating time shift %d: %v\n", id, err)
+        }
+    }
+    fmt.Printf("Undo of time shift %d complete. Restored: %d, Skipped: %d, Errors: %d\n", id, restored, skipped, errors)
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+    "fmt"
+    "strings"
+    "time"
+    // Time zone names must work without a system zoneinfo database
+    _ "time/tzdata"
+)
+
+// Photos record the camera's local wall clock time, usually without saying
+// which time zone it is in, while video creation times are UTC. Capture
+// times are kept as local time with their offset from UTC where it is known,
+// from the EXIF offset tags or from the time zone configured for the camera,
+// so that photos and videos taken together are filed together.
+
+var (
+    defaultTZ string
+    cameraTZ  map[string]string
+)
+
+// defaultTimeZone and cameraTimeZones are set up from --default-tz and
+// --camera-tz. cameraTimeZones is keyed by lower case camera model.
+var (
+    defaultTimeZone *time.Location
+    cameraTimeZones map[string]*time.Location
+)
+
+// setupTimeZones parses the --default-tz and --camera-tz options.
+func setupTimeZones(defaultName string, cameras map[string]string) error {
+    defaultTimeZone = nil
+    if defaultName != "" {
+        loc, err := loadTimeZone(defaultName)
+        if err != nil {
+            return err
+        }
+        defaultTimeZone = loc
+    }
+    cameraTimeZones = make(map[string]*time.Location)
+    for model, name := range cameras {
+        loc, err := loadTimeZone(name)
+        if err != nil {
+            return fmt.Errorf("camera %q: %w", model, err)
+        }
+        cameraTimeZones[strings.ToLower(strings.TrimSpace(model))] = loc
+    }
+    return nil
+}
+
+// loadTimeZone accepts a zone name such as Europe/Helsinki, which follows
+// daylight saving time, or a fixed offset such as +02:00.
+func loadTimeZone(name string) (*time.Location, error) {
+    if seconds, err := parseUTCOffset(name); err == nil {
+        return time.FixedZone(name, seconds), nil
+    }
+    loc, err := time.LoadLocation(name)
+    if err != nil {
+        return nil, fmt.Errorf("unknown time zone %q", name)
+    }
+    return loc, nil
+}
+
+// cameraTimeZone returns the configured time zone of a camera model, or
+// nil if neither --camera-tz nor --default-tz applies.
+func cameraTimeZone(model string) *time.Location {
+    if loc, ok := cameraTimeZones[strings.ToLower(strings.TrimSpace(model))]; ok {
+        return loc
+    }
+    return defaultTimeZone
+}
+
+// withWallClock returns the time with the same wall clock reading in loc.
+func withWallClock(t time.Time, loc *time.Location) time.Time {
+    return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+}
+
+// setTimeZone records the offset from UTC of metadata.DateTime.
+func (m *MediaMetadata) setTimeZone() {
+    _, seconds := m.DateTime.Zone()
+    minutes := seconds / 60
+    m.TZOffset = &minutes
+}
+
+// formatTZOffset formats an offset in minutes as +hh:mm.
+func formatTZOffset(minutes *int) string {
+    if minutes == nil {
+        return "unknown"
+    }
+    sign := '+'
+    m := *minutes
+    if m < 0 {
+        sign = '-'
+        m = -m
+    }
+    return fmt.Sprintf("%c%02d:%02d", sign, m/60, m%60)
+}
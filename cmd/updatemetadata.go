@@ -4,8 +4,7 @@ import (
     "database/sql"
     "fmt"
     "os"
-    "path/filepath"
-
+    "strconv"
 
     "github.com/spf13/cobra"
     _ "github.com/mattn/go-sqlite3"
@@ -16,6 +15,7 @@ var updateMetadataCmd = &cobra.Command{
     Short: "Update metadata in the database from media files",
     Long:  `Scan through all media files in the database and update their metadata based on the current file content.`,
     Args:  cobra.ExactArgs(1),
+    Annotations: map[string]string{libraryArgAnnotation: "0"},
     Run: func(cmd *cobra.Command, args []string) {
         destDir := args[0]
         updateDatabaseMetadata(destDir)
@@ -23,62 +23,117 @@ var updateMetadataCmd = &cobra.Command{
 }
 
 var (
-    updateType string
-    dryRun     bool
+    updateType        string
+    dryRun            bool
+    lowConfidenceOnly bool
 )
 
 func init() {
     rootCmd.AddCommand(updateMetadataCmd)
     updateMetadataCmd.Flags().StringVarP(&updateType, "type", "t", "all", "Type of media to update (all, video, image, or image_raw)")
 	updateMetadataCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "Perform a dry run without making any changes")
+    updateMetadataCmd.Flags().BoolVar(&lowConfidenceOnly, "low-confidence", false, "Only update files whose date may be wrong (EXIF DateTime, folder name, modification time or unknown)")
+    updateMetadataCmd.Flags().StringVar(&defaultTZ, "default-tz", "", "Time zone of cameras that do not record one, e.g. Europe/Helsinki or +02:00")
+    updateMetadataCmd.Flags().StringToStringVar(&cameraTZ, "camera-tz", nil, "Time zone per camera model, e.g. \"Canon EOS R6=Europe/Helsinki\"")
+    updateMetadataCmd.Flags().StringSliceVar(&datePatternFlags, "date-pattern", nil, "Extra regular expression for dates in file and folder names, as for import")
+    updateMetadataCmd.Flags().StringVar(&geoNamesFile, "geonames", "", "GeoNames cities file for place names (default <archive_directory>/geonames/cities15000.txt if present)")
 }
 
 func updateDatabaseMetadata(destDir string) {
-    dbPath := filepath.Join(destDir, "media.db")
-    db, err := sql.Open("sqlite3", dbPath)
+    db, err := initDB(destDir)
     if err != nil {
         fmt.Printf("Error opening database: %v\n", err)
         return
     }
     defer db.Close()
 
-    query := `SELECT id, new_path, file_type, date_taken, location, camera_model, camera_make, camera_type, resolution FROM media`
+    if err := setupGeocoder(geoNamesFile, destDir); err != nil {
+        fmt.Printf("Error loading place names: %v\n", err)
+        return
+    }
+    if err := setupTimeZones(defaultTZ, cameraTZ); err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+    if err := setupDatePatterns(datePatternFlags); err != nil {
+        fmt.Printf("Error: %v\n", err)
+        return
+    }
+
+    // Files marked missing by reconcile are not looked for
+    query := `SELECT id, new_path, original_path, file_type, date_taken, location, latitude, longitude, altitude, camera_model, camera_make, camera_type, resolution, COALESCE(duration, 0),
+        COALESCE(lens_model, ''), COALESCE(focal_length, 0), COALESCE(aperture, 0), COALESCE(exposure_time, 0), COALESCE(iso, 0),
+        COALESCE(flash, ''), COALESCE(orientation, 0), COALESCE(exposure_program, ''), COALESCE(serial_number, ''),
+        COALESCE(country, ''), COALESCE(region, ''), COALESCE(city, ''), tz_offset, COALESCE(date_source, ''), COALESCE(content_id, '')
+        FROM media WHERE status != ?`
+    queryArgs := []interface{}{mediaMissing}
     if updateType != "all" {
-        query += fmt.Sprintf(" WHERE file_type = '%s'", updateType)
+        query += ` AND file_type = ?`
+        queryArgs = append(queryArgs, updateType)
+    }
+    if lowConfidenceOnly {
+        condition, conditionArgs := lowConfidenceFilter()
+        query += ` AND ` + condition
+        queryArgs = append(queryArgs, conditionArgs...)
     }
 
-    rows, err := db.Query(query)
+    // The database has a single connection, so the rows are read before
+    // any of them is updated
+    type mediaRecord struct {
+        id           int
+        newPath      string
+        originalPath string
+        fileType     string
+        metadata MediaMetadata
+    }
+    var records []mediaRecord
+    rows, err := db.Query(query, queryArgs...)
     if err != nil {
         fmt.Printf("Error querying database: %v\n", err)
         return
     }
-    defer rows.Close()
-
     var updated, errors, unchanged int
-
     for rows.Next() {
-        var id int
-        var oldMetadata MediaMetadata
-        var newPath, fileType string
-        err := rows.Scan(&id, &newPath, &fileType, &oldMetadata.DateTime, &oldMetadata.Location, &oldMetadata.CameraModel, &oldMetadata.CameraMake, &oldMetadata.CameraType, &oldMetadata.Resolution)
+        var r mediaRecord
+        err := rows.Scan(&r.id, &r.newPath, &r.originalPath, &r.fileType, &r.metadata.DateTime, &r.metadata.Location, &r.metadata.Latitude, &r.metadata.Longitude, &r.metadata.Altitude, &r.metadata.CameraModel, &r.metadata.CameraMake, &r.metadata.CameraType, &r.metadata.Resolution, &r.metadata.Duration,
+            &r.metadata.LensModel, &r.metadata.FocalLength, &r.metadata.Aperture, &r.metadata.ExposureTime, &r.metadata.ISO,
+            &r.metadata.Flash, &r.metadata.Orientation, &r.metadata.ExposureProgram, &r.metadata.SerialNumber,
+            &r.metadata.Country, &r.metadata.Region, &r.metadata.City, &r.metadata.TZOffset, &r.metadata.DateSource, &r.metadata.ContentID)
         if err != nil {
             fmt.Printf("Error scanning row: %v\n", err)
             errors++
             continue
         }
+        records = append(records, r)
+    }
+    rows.Close()
+
+    for _, r := range records {
+        id, newPath, oldMetadata := r.id, r.newPath, r.metadata
 
         if _, err := os.Stat(newPath); os.IsNotExist(err) {
-            fmt.Printf("File not found: %s\n", newPath)
+            fmt.Printf("File not found: %s (use reconcile to mark it missing)\n", newPath)
             errors++
             continue
         }
 
-        newMetadata, err := getMediaMetadata(newPath)
+        // Dates in names are taken from the name the file was imported with
+        newMetadata, err := getMediaMetadata(newPath, r.originalPath)
         if err != nil {
             fmt.Printf("Error getting metadata for %s: %v\n", newPath, err)
             errors++
             continue
         }
+        // Positions added by geotag are not in the file, keep them
+        if newMetadata.Latitude == nil && oldMetadata.Latitude != nil {
+            newMetadata.setLocation(*oldMetadata.Latitude, *oldMetadata.Longitude, oldMetadata.Altitude)
+            newMetadata.Country, newMetadata.Region, newMetadata.City = oldMetadata.Country, oldMetadata.Region, oldMetadata.City
+            lookupPlace(&newMetadata)
+        }
+        // So are capture times from Google Takeout
+        if oldMetadata.DateSource == dateFromTakeout && takeoutOverrides(newMetadata.DateSource) {
+            newMetadata.DateTime, newMetadata.TZOffset, newMetadata.DateSource = oldMetadata.DateTime, oldMetadata.TZOffset, oldMetadata.DateSource
+        }
 
         changes := compareMetadata(oldMetadata, newMetadata)
         if len(changes) > 0 {
@@ -115,9 +170,18 @@ func compareMetadata(old, new MediaMetadata) []string {
     if !old.DateTime.Equal(new.DateTime) {
         changes = append(changes, fmt.Sprintf("Date/Time: %v -> %v", old.DateTime, new.DateTime))
     }
+    if old.DateSource != new.DateSource {
+        changes = append(changes, fmt.Sprintf("Date Source: %s -> %s", old.DateSource, new.DateSource))
+    }
+    if !equalIntPtr(old.TZOffset, new.TZOffset) {
+        changes = append(changes, fmt.Sprintf("Time Zone: %s -> %s", formatTZOffset(old.TZOffset), formatTZOffset(new.TZOffset)))
+    }
     if old.Location != new.Location {
         changes = append(changes, fmt.Sprintf("Location: %s -> %s", old.Location, new.Location))
     }
+    if !equalFloatPtr(old.Altitude, new.Altitude) {
+        changes = append(changes, fmt.Sprintf("Altitude: %s -> %s", formatFloatPtr(old.Altitude), formatFloatPtr(new.Altitude)))
+    }
     if old.CameraModel != new.CameraModel {
         changes = append(changes, fmt.Sprintf("Camera Model: %s -> %s", old.CameraModel, new.CameraModel))
     }
@@ -130,6 +194,42 @@ func compareMetadata(old, new MediaMetadata) []string {
     if old.Resolution != new.Resolution {
         changes = append(changes, fmt.Sprintf("Resolution: %s -> %s", old.Resolution, new.Resolution))
     }
+    if old.Duration != new.Duration {
+        changes = append(changes, fmt.Sprintf("Duration: %.3fs -> %.3fs", old.Duration, new.Duration))
+    }
+    if old.LensModel != new.LensModel {
+        changes = append(changes, fmt.Sprintf("Lens: %s -> %s", old.LensModel, new.LensModel))
+    }
+    if old.FocalLength != new.FocalLength {
+        changes = append(changes, fmt.Sprintf("Focal Length: %gmm -> %gmm", old.FocalLength, new.FocalLength))
+    }
+    if old.Aperture != new.Aperture {
+        changes = append(changes, fmt.Sprintf("Aperture: f/%g -> f/%g", old.Aperture, new.Aperture))
+    }
+    if old.ExposureTime != new.ExposureTime {
+        changes = append(changes, fmt.Sprintf("Exposure Time: %gs -> %gs", old.ExposureTime, new.ExposureTime))
+    }
+    if old.ISO != new.ISO {
+        changes = append(changes, fmt.Sprintf("ISO: %d -> %d", old.ISO, new.ISO))
+    }
+    if old.Flash != new.Flash {
+        changes = append(changes, fmt.Sprintf("Flash: %s -> %s", old.Flash, new.Flash))
+    }
+    if old.Orientation != new.Orientation {
+        changes = append(changes, fmt.Sprintf("Orientation: %d -> %d", old.Orientation, new.Orientation))
+    }
+    if old.ExposureProgram != new.ExposureProgram {
+        changes = append(changes, fmt.Sprintf("Exposure Program: %s -> %s", old.ExposureProgram, new.ExposureProgram))
+    }
+    if old.SerialNumber != new.SerialNumber {
+        changes = append(changes, fmt.Sprintf("Serial Number: %s -> %s", old.SerialNumber, new.SerialNumber))
+    }
+    if old.ContentID != new.ContentID {
+        changes = append(changes, fmt.Sprintf("Content ID: %s -> %s", old.ContentID, new.ContentID))
+    }
+    if old.Country != new.Country || old.Region != new.Region || old.City != new.City {
+        changes = append(changes, fmt.Sprintf("Place: %s -> %s", formatPlace(old), formatPlace(new)))
+    }
     return changes
 }
 
@@ -137,8 +237,34 @@ func compareMetadata(old, new MediaMetadata) []string {
 func updateMediaRecord(db *sql.DB, id int, metadata MediaMetadata) error {
     _, err := db.Exec(`
         UPDATE media 
-        SET date_taken = ?, location = ?, camera_model = ?, camera_make = ?, camera_type = ?, resolution = ?
+        SET date_taken = ?, location = ?, latitude = ?, longitude = ?, altitude = ?, camera_model = ?, camera_make = ?, camera_type = ?, resolution = ?, duration = ?,
+            lens_model = ?, focal_length = ?, aperture = ?, exposure_time = ?, iso = ?, flash = ?, orientation = ?, exposure_program = ?, serial_number = ?,
+            country = ?, region = ?, city = ?, tz_offset = ?, date_source = ?, content_id = ?
         WHERE id = ?`,
-        metadata.DateTime, metadata.Location, metadata.CameraModel, metadata.CameraMake, metadata.CameraType, metadata.Resolution, id)
+        metadata.DateTime, metadata.Location, metadata.Latitude, metadata.Longitude, metadata.Altitude, metadata.CameraModel, metadata.CameraMake, metadata.CameraType, metadata.Resolution, nullIfZero(metadata.Duration),
+        nullIfZero(metadata.LensModel), nullIfZero(metadata.FocalLength), nullIfZero(metadata.Aperture), nullIfZero(metadata.ExposureTime), nullIfZero(metadata.ISO),
+        nullIfZero(metadata.Flash), nullIfZero(metadata.Orientation), nullIfZero(metadata.ExposureProgram), nullIfZero(metadata.SerialNumber),
+        nullIfZero(metadata.Country), nullIfZero(metadata.Region), nullIfZero(metadata.City), metadata.TZOffset, nullIfZero(metadata.DateSource), nullIfZero(metadata.ContentID), id)
     return err
-}
\ No newline at end of file
+}
+
+func equalFloatPtr(a, b *float64) bool {
+    if a == nil || b == nil {
+        return a == b
+    }
+    return *a == *b
+}
+
+func equalIntPtr(a, b *int) bool {
+    if a == nil || b == nil {
+        return a == b
+    }
+    return *a == *b
+}
+
+func formatFloatPtr(f *float64) string {
+    if f == nil {
+        return "none"
+    }
+    return strconv.FormatFloat(*f, 'f', -1, 64)
+}
@@ -0,0 +1,264 @@
+package cmd
+
+import (
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "math"
+    "os"
+    "runtime"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/spf13/cobra"
+)
+
+var verifyCmd = &cobra.Command{
+    Use:   "verify [archive_directory]",
+    Short: "Check library files against their recorded hashes",
+    Long: `Re-hash the files in the library and compare them with the hashes recorded
+at import, reporting missing, modified (bit-rot) and unreadable files.
+
+Files that have never been checked are checked first, then the ones checked
+longest ago, so running for example "verify --sample 0.05" every night
+scrubs the whole library within 20 days.`,
+    Args:        cobra.ExactArgs(1),
+    Annotations: map[string]string{libraryArgAnnotation: "0"},
+    Run: func(cmd *cobra.Command, args []string) {
+        destDir := args[0]
+        // Exit only once verifyLibrary has closed the database
+        if verifyLibrary(destDir) {
+            os.Exit(1)
+        }
+    },
+}
+
+var (
+    verifySince  string
+    verifySample float64
+    jsonOutput   bool
+)
+
+func init() {
+    rootCmd.AddCommand(verifyCmd)
+    verifyCmd.Flags().StringVar(&verifySince, "since", "", "Only check files not verified within this period, e.g. 30d, 2w or 12h")
+    verifyCmd.Flags().Float64Var(&verifySample, "sample", 1, "Fraction of the library to check in this run, starting with the files verified longest ago")
+    verifyCmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the report as JSON")
+    verifyCmd.Flags().IntVarP(&workers, "workers", "w", 1, "Number of files to hash in parallel. 0 means one per CPU.")
+}
+
+// Values of media.verify_status
+const (
+    verifyOK         = "ok"
+    verifyMissing    = "missing"
+    verifyMismatch   = "mismatch"
+    verifyUnreadable = "unreadable"
+)
+
+type verifyTarget struct {
+    id      int64
+    hash    uint64
+    newPath string
+}
+
+type VerifyResult struct {
+    ID           int64  `json:"id"`
+    Path         string `json:"path"`
+    Status       string `json:"status"`
+    ExpectedHash string `json:"expected_hash,omitempty"`
+    ActualHash   string `json:"actual_hash,omitempty"`
+    Error        string `json:"error,omitempty"`
+}
+
+type VerifyReport struct {
+    Checked    int            `json:"checked"`
+    OK         int            `json:"ok"`
+    Missing    int            `json:"missing"`
+    Mismatch   int            `json:"mismatch"`
+    Unreadable int            `json:"unreadable"`
+    Problems   []VerifyResult `json:"problems"`
+}
+
+// verifyLibrary checks the library and reports whether problems were found.
+func verifyLibrary(destDir string) (problems bool) {
+    if verifySample <= 0 || verifySample > 1 {
+        fmt.Printf("Error: --sample must be between 0 and 1\n")
+        return false
+    }
+    var cutoff time.Time
+    if verifySince != "" {
+        age, err := parseAge(verifySince)
+        if err != nil {
+            fmt.Printf("Error: %v\n", err)
+            return false
+        }
+        cutoff = time.Now().UTC().Add(-age)
+    }
+
+    db, err := initDB(destDir)
+    if err != nil {
+        fmt.Printf("Error opening database: %v\n", err)
+        return false
+    }
+    defer db.Close()
+
+    targets, err := selectVerifyTargets(db, cutoff)
+    if err != nil {
+        fmt.Printf("Error querying database: %v\n", err)
+        return false
+    }
+
+    report := VerifyReport{Problems: []VerifyResult{}}
+    for result := range hashVerifyTargets(targets) {
+        report.Checked++
+        switch result.Status {
+        case verifyOK:
+            report.OK++
+        case verifyMissing:
+            report.Missing++
+        case verifyMismatch:
+            report.Mismatch++
+        case verifyUnreadable:
+            report.Unreadable++
+        }
+        if result.Status != verifyOK {
+            report.Problems = append(report.Problems, result)
+            if !jsonOutput {
+                printVerifyProblem(result)
+            }
+        }
+        _, err := db.Exec(`UPDATE media SET last_verified = ?, verify_status = ? WHERE id = ?`, time.Now().UTC(), result.Status, result.ID)
+        if err != nil {
+            fmt.Printf("Error updating record for %s: %v\n", result.Path, err)
+        }
+    }
+
+    if jsonOutput {
+        encoder := json.NewEncoder(os.Stdout)
+        encoder.SetIndent("", "  ")
+        encoder.Encode(report)
+    } else {
+        fmt.Printf("Verification complete. Checked: %d, OK: %d, Missing: %d, Mismatch: %d, Unreadable: %d\n",
+            report.Checked, report.OK, report.Missing, report.Mismatch, report.Unreadable)
+    }
+    return len(report.Problems) > 0
+}
+
+// selectVerifyTargets returns the files due for checking, least recently
+// verified first, limited to the --sample fraction of the library.
+func selectVerifyTargets(db *sql.DB, cutoff time.Time) ([]verifyTarget, error) {
+    var total int
+    err := db.QueryRow(`SELECT COUNT(*) FROM media WHERE status = ?`, mediaOK).Scan(&total)
+    if err != nil {
+        return nil, err
+    }
+    limit := int(math.Ceil(float64(total) * verifySample))
+
+    query := `SELECT id, hash, new_path FROM media WHERE status = ?`
+    queryArgs := []interface{}{mediaOK}
+    if !cutoff.IsZero() {
+        query += ` AND (last_verified IS NULL OR last_verified < ?)`
+        queryArgs = append(queryArgs, cutoff)
+    }
+    query += ` ORDER BY last_verified IS NOT NULL, last_verified, id LIMIT ?`
+    queryArgs = append(queryArgs, limit)
+
+    rows, err := db.Query(query, queryArgs...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var targets []verifyTarget
+    for rows.Next() {
+        var t verifyTarget
+        var hash int64
+        if err := rows.Scan(&t.id, &hash, &t.newPath); err != nil {
+            return nil, err
+        }
+        t.hash = uint64(hash)
+        targets = append(targets, t)
+    }
+    return targets, rows.Err()
+}
+
+// hashVerifyTargets checks the targets on a pool of workers.
+func hashVerifyTargets(targets []verifyTarget) <-chan VerifyResult {
+    numWorkers := workers
+    if numWorkers <= 0 {
+        numWorkers = runtime.NumCPU()
+    }
+    jobs := make(chan verifyTarget)
+    results := make(chan VerifyResult)
+
+    var wg sync.WaitGroup
+    wg.Add(numWorkers)
+    for i := 0; i < numWorkers; i++ {
+        go func() {
+            defer wg.Done()
+            for target := range jobs {
+                results <- verifyFile(target)
+            }
+        }()
+    }
+    go func() {
+        for _, target := range targets {
+            jobs <- target
+        }
+        close(jobs)
+        wg.Wait()
+        close(results)
+    }()
+    return results
+}
+
+func verifyFile(target verifyTarget) VerifyResult {
+    result := VerifyResult{ID: target.id, Path: target.newPath, Status: verifyOK}
+    if _, err := os.Stat(target.newPath); os.IsNotExist(err) {
+        result.Status = verifyMissing
+        return result
+    }
+    hash, err := computeXXHash(target.newPath)
+    if err != nil {
+        result.Status = verifyUnreadable
+        result.Error = err.Error()
+        return result
+    }
+    if hash != target.hash {
+        result.Status = verifyMismatch
+        result.ExpectedHash = fmt.Sprintf("%016x", target.hash)
+        result.ActualHash = fmt.Sprintf("%016x", hash)
+    }
+    return result
+}
+
+func printVerifyProblem(result VerifyResult) {
+    switch result.Status {
+    case verifyMissing:
+        fmt.Printf("MISSING     %s\n", result.Path)
+    case verifyMismatch:
+        fmt.Printf("MISMATCH    %s (expected %s, got %s)\n", result.Path, result.ExpectedHash, result.ActualHash)
+    case verifyUnreadable:
+        fmt.Printf("UNREADABLE  %s: %s\n", result.Path, result.Error)
+    }
+}
+
+// parseAge parses a duration that may also use days (d) and weeks (w).
+func parseAge(s string) (time.Duration, error) {
+    for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+        if strings.HasSuffix(s, suffix) {
+            n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+            if err != nil {
+                return 0, fmt.Errorf("invalid duration %q", s)
+            }
+            return time.Duration(n * float64(unit)), nil
+        }
+    }
+    d, err := time.ParseDuration(s)
+    if err != nil {
+        return 0, fmt.Errorf("invalid duration %q", s)
+    }
+    return d, nil
+}
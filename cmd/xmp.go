@@ -0,0 +1,178 @@
+package cmd
+
+import (
+    "bytes"
+    "encoding/xml"
+    "fmt"
+    "math"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// XMP sidecars hold metadata for files picmover does not write into, such
+// as RAW files. A sidecar is named after the file with an .xmp extension,
+// IMG_0001.CR2 -> IMG_0001.xmp, which is what Lightroom and most other
+// programs read.
+
+// xmpNamespaces are the namespaces of the properties picmover writes.
+var xmpNamespaces = map[string]string{
+    "exif":      "http://ns.adobe.com/exif/1.0/",
+    "xmp":       "http://ns.adobe.com/xap/1.0/",
+    "photoshop": "http://ns.adobe.com/photoshop/1.0/",
+}
+
+// emptyXMP is the start of a new sidecar.
+const emptyXMP = "<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n" + `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""/>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>
+`
+
+var xmpDescriptionPattern = regexp.MustCompile(`<rdf:Description\b[^>]*?(/?)>`)
+
+// xmpProperty is a simple property such as exif:GPSLatitude.
+type xmpProperty struct {
+    name  string // prefixed name, e.g. "exif:GPSLatitude"
+    value string
+}
+
+func xmpSidecarPath(path string) string {
+    return strings.TrimSuffix(path, filepath.Ext(path)) + ".xmp"
+}
+
+// writeXMPSidecar sets properties in the sidecar of a file, creating it if
+// needed. Other content of an existing sidecar is kept.
+func writeXMPSidecar(path string, properties []xmpProperty) error {
+    sidecar := xmpSidecarPath(path)
+    content, err := os.ReadFile(sidecar)
+    // CreateTemp makes the new file private to its owner, so its permissions
+    // are set to those of the existing sidecar
+    mode := os.FileMode(0644)
+    if os.IsNotExist(err) {
+        content = []byte(emptyXMP)
+    } else if err != nil {
+        return err
+    } else if info, err := os.Stat(sidecar); err == nil {
+        mode = info.Mode().Perm()
+    }
+    updated, err := setXMPProperties(content, properties)
+    if err != nil {
+        return fmt.Errorf("%s: %w", sidecar, err)
+    }
+
+    temp, err := os.CreateTemp(filepath.Dir(sidecar), tempFilePrefix+"*.tmp")
+    if err != nil {
+        return err
+    }
+    tempPath := temp.Name()
+    if _, err = temp.Write(updated); err == nil {
+        err = temp.Chmod(mode)
+    }
+    if err == nil {
+        err = temp.Close()
+    } else {
+        temp.Close()
+    }
+    if err == nil {
+        err = os.Rename(tempPath, sidecar)
+    }
+    if err != nil {
+        os.Remove(tempPath)
+    }
+    return err
+}
+
+// setXMPProperties replaces or adds the properties as attributes of the
+// first rdf:Description.
+func setXMPProperties(content []byte, properties []xmpProperty) ([]byte, error) {
+    // Earlier values may be attributes or elements anywhere in the packet
+    for _, property := range properties {
+        name := regexp.QuoteMeta(property.name)
+        attribute := regexp.MustCompile(`\s+` + name + `\s*=\s*("[^"]*"|'[^']*')`)
+        element := regexp.MustCompile(`(?s)<` + name + `\s*>.*?</` + name + `\s*>|<` + name + `\s*/>`)
+        content = attribute.ReplaceAll(content, nil)
+        content = element.ReplaceAll(content, nil)
+    }
+
+    match := xmpDescriptionPattern.FindSubmatchIndex(content)
+    if match == nil {
+        return nil, fmt.Errorf("no rdf:Description found")
+    }
+    // Insert before the ">" or "/>" closing the start tag
+    insertAt := match[2]
+
+    var attributes bytes.Buffer
+    declared := make(map[string]bool)
+    for _, property := range properties {
+        prefix := strings.SplitN(property.name, ":", 2)[0]
+        if !declared[prefix] && !bytes.Contains(content, []byte("xmlns:"+prefix+"=")) {
+            fmt.Fprintf(&attributes, "\n    xmlns:%s=\"%s\"", prefix, xmpNamespaces[prefix])
+        }
+        declared[prefix] = true
+    }
+    for _, property := range properties {
+        fmt.Fprintf(&attributes, "\n    %s=\"", property.name)
+        xml.EscapeText(&attributes, []byte(property.value))
+        attributes.WriteString(`"`)
+    }
+
+    var result bytes.Buffer
+    result.Write(content[:insertAt])
+    result.Write(attributes.Bytes())
+    result.Write(content[insertAt:])
+    return result.Bytes(), nil
+}
+
+// xmpGPSProperties returns a position in the XMP form of the Exif GPS tags.
+func xmpGPSProperties(lat, long float64, altitude *float64) []xmpProperty {
+    properties := []xmpProperty{
+        {"exif:GPSVersionID", "2.2.0.0"},
+        {"exif:GPSLatitude", xmpGPSCoordinate(lat, "N", "S")},
+        {"exif:GPSLongitude", xmpGPSCoordinate(long, "E", "W")},
+    }
+    if altitude != nil {
+        ref := "0"
+        if *altitude < 0 {
+            ref = "1"
+        }
+        properties = append(properties,
+            xmpProperty{"exif:GPSAltitudeRef", ref},
+            xmpProperty{"exif:GPSAltitude", strconv.FormatInt(int64(math.Round(math.Abs(*altitude)*100)), 10) + "/100"},
+        )
+    }
+    return properties
+}
+
+// xmpGPSCoordinate formats an angle as degrees and decimal minutes followed
+// by the hemisphere, e.g. "60,10.194000N".
+func xmpGPSCoordinate(angle float64, positive, negative string) string {
+    ref := positive
+    if angle < 0 {
+        ref = negative
+        angle = -angle
+    }
+    degrees := math.Floor(angle)
+    minutes := (angle - degrees) * 60
+    return fmt.Sprintf("%d,%.6f%s", int(degrees), minutes, ref)
+}
+
+// xmpDateProperties returns a capture time in the XMP date properties that
+// photo programs read. The offset from UTC is only written if it is known.
+func xmpDateProperties(t time.Time, zoned bool) []xmpProperty {
+    layout := "2006-01-02T15:04:05"
+    if zoned {
+        layout += "-07:00"
+    }
+    date := t.Format(layout)
+    return []xmpProperty{
+        {"exif:DateTimeOriginal", date},
+        {"xmp:CreateDate", date},
+        {"photoshop:DateCreated", date},
+    }
+}